@@ -0,0 +1,86 @@
+// attempts.go - delivery attempts of notifications
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeliveryAttempt records one try to deliver a notification over a channel.
+// Notifications on the "auto" channel make one attempt per channel tried.
+type DeliveryAttempt struct {
+	// Attempt counts the deliveries of the notification, starting at 1; a retry adds one.
+	Attempt  int       `json:"attempt"`
+	Channel  string    `json:"channel"`
+	Response string    `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// recordAttempt appends the outcome of sending the notification over channel to its attempts.
+func (d *DelayedNotifier) recordAttempt(ctx context.Context, notification *Notification, channel string, at time.Time, response string, sendErr error) {
+	attempt := DeliveryAttempt{
+		Attempt:  notification.Retries + 1,
+		Channel:  channel,
+		Response: response,
+		At:       at,
+	}
+	if sendErr != nil {
+		attempt.Error = sendErr.Error()
+	}
+	if err := d.store.AddAttempt(ctx, notification.ID, attempt); err != nil {
+		log.Printf("error recording delivery attempt of notification %s: %v", notification.ID, err)
+	}
+}
+
+// ListAttempts returns the delivery attempts of a notification of the
+// context's tenant, oldest first. Only admins see the responses in full;
+// others get their status, since a response body is the receiver's data.
+func (d *DelayedNotifier) ListAttempts(ctx context.Context, id string) ([]DeliveryAttempt, error) {
+	if _, err := d.ownNotification(ctx, id); err != nil {
+		return nil, err
+	}
+	attempts, err := d.store.ListAttempts(ctx, id)
+	if err != nil || isAdmin(ctx) {
+		return attempts, err
+	}
+	for i := range attempts {
+		attempts[i].Response = responseStatus(attempts[i].Response)
+	}
+	return attempts, nil
+}
+
+// responseStatus returns the status part of a recorded response, such as
+// "HTTP 200" or "message_id 42", without the body that follows it.
+func responseStatus(response string) string {
+	fields := strings.Fields(response)
+	return strings.Join(fields[:min(len(fields), 2)], " ")
+}
+
+// ListAttemptsHandler handles GET /notify/{id}/attempts.
+func (d *DelayedNotifier) ListAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/notify/"), "/attempts")
+	attempts, err := d.ListAttempts(r.Context(), id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]DeliveryAttempt{"result": attempts})
+}
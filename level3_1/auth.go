@@ -0,0 +1,243 @@
+// auth.go - API keys, tenant isolation and per-tenant quotas
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// APIKeyHeader carries an API key; "Authorization: Bearer <key>" works as well.
+const APIKeyHeader = "X-API-Key"
+
+// AnyTenant configures the quota of tenants without a quota of their own.
+const AnyTenant = "*"
+
+// errQuotaExceeded is returned when a tenant has used up its quota.
+var errQuotaExceeded = errors.New("notification quota exceeded")
+
+// APIKey scopes an API key to a tenant. Admin keys may also use the /admin
+// endpoints, which are shared by all tenants, and manage the templates and
+// user preferences of other tenants.
+type APIKey struct {
+	Tenant string `json:"tenant"`
+	Admin  bool   `json:"admin"`
+}
+
+// ParseAPIKeys reads API keys from JSON such as {"k3y": {"tenant": "acme"}, "s3cret": {"tenant": "ops", "admin": true}}.
+func ParseAPIKeys(s string) (map[string]APIKey, error) {
+	keys := map[string]APIKey{}
+	if s == "" {
+		return keys, nil
+	}
+	if err := json.Unmarshal([]byte(s), &keys); err != nil {
+		return nil, fmt.Errorf("invalid API keys: %v", err)
+	}
+	for key, k := range keys {
+		if key == "" || k.Tenant == "" {
+			return nil, fmt.Errorf("invalid API keys: every key needs a tenant")
+		}
+	}
+	return keys, nil
+}
+
+// tenantKey is the context key of the authenticated tenant.
+type tenantKey struct{}
+
+// withTenant returns a copy of ctx that carries tenant.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant a request was authenticated as. It is empty
+// when authentication is off, which gives access to every tenant.
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// adminKey is the context key that marks requests made with an admin key.
+type adminKey struct{}
+
+// withAdmin returns a copy of ctx that is marked as coming from an admin key.
+func withAdmin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, adminKey{}, true)
+}
+
+// isAdmin reports whether the request behind ctx used an admin key. Like
+// tenantFrom, it grants everything when authentication is off.
+func isAdmin(ctx context.Context) bool {
+	if tenantFrom(ctx) == "" {
+		return true
+	}
+	admin, _ := ctx.Value(adminKey{}).(bool)
+	return admin
+}
+
+// requestKey returns the API key sent with r.
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// publicPath reports whether path is served without an API key.
+func publicPath(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/metrics"
+}
+
+// adminRequest reports whether r needs an admin key.
+func adminRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/admin/")
+}
+
+// requestTenant returns the tenant whose templates or preferences r is about:
+// the one named by ?tenant_id=, by default the caller's own. It reports false
+// when a caller without an admin key names another tenant.
+func requestTenant(r *http.Request) (string, bool) {
+	own := tenantFrom(r.Context())
+	tenant := r.URL.Query().Get("tenant_id")
+	if tenant == "" || tenant == own {
+		return own, true
+	}
+	return tenant, isAdmin(r.Context())
+}
+
+// AuthMiddleware rejects requests without a valid API key and passes the
+// key's tenant on in the request context.
+func AuthMiddleware(keys map[string]APIKey, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, ok := keys[requestKey(r)]
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, `{"error": "missing or invalid API key"}`, http.StatusUnauthorized)
+			return
+		}
+		if adminRequest(r) && !key.Admin {
+			http.Error(w, `{"error": "this endpoint needs an admin API key"}`, http.StatusForbidden)
+			return
+		}
+		ctx := withTenant(r.Context(), key.Tenant)
+		if key.Admin {
+			ctx = withAdmin(ctx)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ownNotification loads a notification of the request's tenant. Notifications
+// of other tenants are reported as not found.
+func (d *DelayedNotifier) ownNotification(ctx context.Context, id string) (*Notification, error) {
+	n, err := d.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if tenant := tenantFrom(ctx); tenant != "" && n.TenantID != tenant {
+		return nil, ErrNotFound
+	}
+	return n, nil
+}
+
+// Quota allows a tenant to create Limit notifications per Per.
+type Quota struct {
+	Limit int
+	Per   time.Duration
+}
+
+// ParseQuotas reads tenant quotas from JSON such as
+// {"acme": {"limit": 100000, "per": "24h"}, "*": {"limit": 1000, "per": "1h"}}.
+func ParseQuotas(s string) (map[string]Quota, error) {
+	quotas := map[string]Quota{}
+	if s == "" {
+		return quotas, nil
+	}
+	var raw map[string]struct {
+		Limit int    `json:"limit"`
+		Per   string `json:"per"`
+	}
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, fmt.Errorf("invalid quotas: %v", err)
+	}
+	for tenant, r := range raw {
+		per, err := time.ParseDuration(r.Per)
+		if err != nil || per < time.Second {
+			return nil, fmt.Errorf("invalid quota for %s: per must be a duration of at least 1s", tenant)
+		}
+		if r.Limit < 1 {
+			return nil, fmt.Errorf("invalid quota for %s: limit must be positive", tenant)
+		}
+		quotas[tenant] = Quota{Limit: r.Limit, Per: per}
+	}
+	return quotas, nil
+}
+
+// reserveQuotaScript adds up to ARGV[1] notifications to the counter in
+// KEYS[1] without passing the limit ARGV[2], and returns how many it added.
+// ARGV[3] is the lifetime of the counter in milliseconds.
+var reserveQuotaScript = redis.NewScript(`
+local want = tonumber(ARGV[1])
+local used = redis.call('INCRBY', KEYS[1], want)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+local over = used - tonumber(ARGV[2])
+if over <= 0 then
+	return want
+end
+local refund = math.min(over, want)
+redis.call('DECRBY', KEYS[1], refund)
+return want - refund
+`)
+
+// quotaReservation is what reserveQuota took from a tenant's quota.
+type quotaReservation struct {
+	tenant  string
+	key     string // counter of the window it was taken from, empty if nothing was counted
+	granted int
+}
+
+// reserveQuota takes up to n notifications from the tenant's quota for the
+// current window and returns how many it got. Like the rate limiter, it
+// lets everything through while Redis is unavailable.
+func (d *DelayedNotifier) reserveQuota(ctx context.Context, tenant string, n int) quotaReservation {
+	quota, ok := d.quotas[tenant]
+	if !ok {
+		quota, ok = d.quotas[AnyTenant]
+	}
+	if !ok || n == 0 {
+		return quotaReservation{tenant: tenant, granted: n}
+	}
+	window := d.now().UnixMilli() / quota.Per.Milliseconds()
+	key := fmt.Sprintf("notifications:quota:%s:%d", tenant, window)
+	granted, err := reserveQuotaScript.Run(ctx, d.redis, []string{key}, n, quota.Limit, quota.Per.Milliseconds()).Int()
+	if err != nil {
+		log.Printf("error checking quota of tenant %s: %v", tenant, err)
+		return quotaReservation{tenant: tenant, granted: n}
+	}
+	return quotaReservation{tenant: tenant, key: key, granted: granted}
+}
+
+// releaseQuota gives n notifications of a reservation back to the window
+// they were taken from, for notifications that were not created after all.
+func (d *DelayedNotifier) releaseQuota(ctx context.Context, r quotaReservation, n int) {
+	if r.key == "" || n == 0 {
+		return
+	}
+	if err := d.redis.DecrBy(ctx, r.key, int64(n)).Err(); err != nil {
+		log.Printf("error releasing quota of tenant %s: %v", r.tenant, err)
+	}
+}
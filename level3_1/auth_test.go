@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys(`{"k1": {"tenant": "acme"}, "k2": {"tenant": "ops", "admin": true}}`)
+	if err != nil {
+		t.Fatalf("ParseAPIKeys failed: %v", err)
+	}
+	if keys["k1"] != (APIKey{Tenant: "acme"}) || !keys["k2"].Admin {
+		t.Errorf("Unexpected keys %+v", keys)
+	}
+	if _, err := ParseAPIKeys(`{"k1": {}}`); err == nil {
+		t.Error("Expected an error for a key without a tenant")
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	quotas, err := ParseQuotas(`{"acme": {"limit": 100, "per": "24h"}, "*": {"limit": 10, "per": "1h"}}`)
+	if err != nil {
+		t.Fatalf("ParseQuotas failed: %v", err)
+	}
+	if quotas["acme"] != (Quota{Limit: 100, Per: 24 * time.Hour}) || quotas[AnyTenant].Limit != 10 {
+		t.Errorf("Unexpected quotas %+v", quotas)
+	}
+	for _, s := range []string{`{"acme": {"limit": 0, "per": "1h"}}`, `{"acme": {"limit": 1, "per": "soon"}}`} {
+		if _, err := ParseQuotas(s); err == nil {
+			t.Errorf("Expected an error for %s", s)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	keys := map[string]APIKey{"user-key": {Tenant: "acme"}, "admin-key": {Tenant: "ops", Admin: true}}
+	var tenant string
+	handler := AuthMiddleware(keys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = tenantFrom(r.Context())
+	}))
+
+	tests := []struct {
+		method, path, header, key string
+		code                      int
+		tenant                    string
+	}{
+		{http.MethodGet, "/healthz", "", "", http.StatusOK, ""},
+		{http.MethodGet, "/notify", "", "", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/notify", APIKeyHeader, "wrong", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/notify", APIKeyHeader, "user-key", http.StatusOK, "acme"},
+		{http.MethodGet, "/notify", "Authorization", "Bearer user-key", http.StatusOK, "acme"},
+		{http.MethodGet, "/templates/welcome", APIKeyHeader, "user-key", http.StatusOK, "acme"},
+		{http.MethodPost, "/templates", APIKeyHeader, "user-key", http.StatusOK, "acme"},
+		{http.MethodGet, "/admin/dlq", APIKeyHeader, "user-key", http.StatusForbidden, ""},
+		{http.MethodGet, "/admin/dlq", APIKeyHeader, "admin-key", http.StatusOK, "ops"},
+		{http.MethodPut, "/users/alice/preferences", APIKeyHeader, "user-key", http.StatusOK, "acme"},
+	}
+	for _, tt := range tests {
+		tenant = ""
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.code || tenant != tt.tenant {
+			t.Errorf("%s %s with %q: expected %d as %q, got %d as %q", tt.method, tt.path, tt.key, tt.code, tt.tenant, rec.Code, tenant)
+		}
+	}
+}
+
+// asTenant returns r as authenticated for tenant.
+func asTenant(r *http.Request, tenant string) *http.Request {
+	return r.WithContext(withTenant(r.Context(), tenant))
+}
+
+// asAdmin returns r as authenticated with an admin key of tenant.
+func asAdmin(r *http.Request, tenant string) *http.Request {
+	return r.WithContext(withAdmin(withTenant(r.Context(), tenant)))
+}
+
+func TestTenantIsolation(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+
+	body := `{"user_id": "alice", "message": "hi", "channel": "email", "send_at": "2099-01-02T09:00:00Z"}`
+	req := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	d.CreateNotificationHandler(rec, asTenant(req, "acme"))
+	var created map[string]string
+	json.NewDecoder(rec.Body).Decode(&created)
+	id := created["result"]
+	if n, err := d.store.Get(context.Background(), id); err != nil || n.TenantID != "acme" {
+		t.Fatalf("Expected a notification of acme, got %+v (%v)", n, err)
+	}
+
+	// Another tenant can neither see nor change it.
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/notify/"+id, nil),
+		httptest.NewRequest(http.MethodGet, "/notify/"+id+"/attempts", nil),
+		httptest.NewRequest(http.MethodPatch, "/notify/"+id, strings.NewReader(`{"message": "hijacked"}`)),
+		httptest.NewRequest(http.MethodDelete, "/notify/"+id, nil),
+	} {
+		rec := httptest.NewRecorder()
+		r = asTenant(r, "globex")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/attempts"):
+			d.ListAttemptsHandler(rec, r)
+		case r.Method == http.MethodGet:
+			d.GetNotificationHandler(rec, r)
+		case r.Method == http.MethodPatch:
+			d.UpdateNotificationHandler(rec, r)
+		default:
+			d.CancelNotificationHandler(rec, r)
+		}
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s %s as another tenant: expected 404, got %d", r.Method, r.URL.Path, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	d.ListNotificationsHandler(rec, asTenant(httptest.NewRequest(http.MethodGet, "/notify?user_id=alice", nil), "globex"))
+	var list struct {
+		Result []*Notification `json:"result"`
+	}
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list.Result) != 0 {
+		t.Errorf("Expected another tenant to list nothing, got %d", len(list.Result))
+	}
+
+	rec = httptest.NewRecorder()
+	d.CancelNotificationHandler(rec, asTenant(httptest.NewRequest(http.MethodDelete, "/notify/"+id, nil), "acme"))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the owner to cancel, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAttemptResponsesNeedAdmin(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+	ctx := withTenant(context.Background(), "acme")
+	id, err := d.CreateNotification(NotificationRequest{TenantID: "acme", UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	d.store.AddAttempt(ctx, id, DeliveryAttempt{Attempt: 1, Channel: "webhook", Response: `HTTP 200 {"internal": "data"}`, At: time.Now()})
+
+	attempts, err := d.ListAttempts(ctx, id)
+	if err != nil || len(attempts) != 1 || attempts[0].Response != "HTTP 200" {
+		t.Errorf("Expected the tenant to see only the status, got %+v (%v)", attempts, err)
+	}
+	attempts, err = d.ListAttempts(withAdmin(ctx), id)
+	if err != nil || len(attempts) != 1 || attempts[0].Response != `HTTP 200 {"internal": "data"}` {
+		t.Errorf("Expected an admin to see the whole response, got %+v (%v)", attempts, err)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+	d.quotas = map[string]Quota{"acme": {Limit: 2, Per: time.Hour}, AnyTenant: {Limit: 1, Per: time.Hour}}
+	req := NotificationRequest{TenantID: "acme", UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)}
+
+	for i := 0; i < 2; i++ {
+		if _, err := d.CreateNotification(req); err != nil {
+			t.Fatalf("CreateNotification %d failed: %v", i, err)
+		}
+	}
+	if _, err := d.CreateNotification(req); err != errQuotaExceeded {
+		t.Errorf("Expected errQuotaExceeded, got %v", err)
+	}
+
+	// globex falls back to the default quota; a batch is cut off where it runs out.
+	req.TenantID = "globex"
+	_, results := d.CreateBatch("globex", []NotificationRequest{req, req, req})
+	if results[0].ID == "" || results[1].Error != errQuotaExceeded.Error() || results[2].Error != errQuotaExceeded.Error() {
+		t.Errorf("Expected only the first item to be accepted, got %+v", results)
+	}
+
+	// The quota is per window.
+	d.now = func() time.Time { return time.Now().Add(time.Hour) }
+	req.TenantID = "acme"
+	req.SendAt = time.Now().Add(2 * time.Hour)
+	if _, err := d.CreateNotification(req); err != nil {
+		t.Errorf("Expected a new window to allow more, got %v", err)
+	}
+}
+
+// brokenStore fails to create notifications while broken is set.
+type brokenStore struct {
+	*MemoryStore
+	broken bool
+}
+
+func (s *brokenStore) Create(ctx context.Context, n *Notification) error {
+	if s.broken {
+		return errors.New("database is down")
+	}
+	return s.MemoryStore.Create(ctx, n)
+}
+
+func (s *brokenStore) CreateMany(ctx context.Context, ns []*Notification) error {
+	if s.broken {
+		return errors.New("database is down")
+	}
+	return s.MemoryStore.CreateMany(ctx, ns)
+}
+
+func TestFailedCreateReleasesQuota(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+	store := &brokenStore{MemoryStore: NewMemoryStore(), broken: true}
+	d.store = store
+	d.quotas = map[string]Quota{"acme": {Limit: 2, Per: time.Hour}}
+	req := NotificationRequest{TenantID: "acme", UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)}
+
+	if _, err := d.CreateNotification(req); err == nil || err == errQuotaExceeded {
+		t.Fatalf("Expected the store error, got %v", err)
+	}
+	if _, results := d.CreateBatch("acme", []NotificationRequest{req, req}); results[0].Error == "" || results[1].Error == errQuotaExceeded.Error() {
+		t.Fatalf("Expected the store error for the whole batch, got %+v", results)
+	}
+
+	// Nothing was created, so the whole quota is still there.
+	store.broken = false
+	for i := 0; i < 2; i++ {
+		if _, err := d.CreateNotification(req); err != nil {
+			t.Fatalf("CreateNotification %d failed: %v", i, err)
+		}
+	}
+	if _, err := d.CreateNotification(req); err != errQuotaExceeded {
+		t.Errorf("Expected errQuotaExceeded, got %v", err)
+	}
+}
+
+func TestWebhookBodiesStayOutOfTenantViews(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal-secret", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	sender := NewWebhookSender("secret")
+	sender.client, sender.allowPrivate = srv.Client(), true
+	d.senders.Register("webhook", sender)
+
+	ctx := context.Background()
+	events := d.redis.Subscribe(ctx, eventsKey("acme", "alice"))
+	defer events.Close()
+	if _, err := events.Receive(ctx); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	id, err := d.CreateNotification(NotificationRequest{TenantID: "acme", UserID: "alice", Message: "hi", Channel: "webhook", Target: srv.URL, SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	d.handleDelivery(<-broker.deliveries)
+
+	for _, path := range []string{"/notify/" + id, "/notify/" + id + "/attempts"} {
+		rec := httptest.NewRecorder()
+		req := asTenant(httptest.NewRequest(http.MethodGet, path, nil), "acme")
+		if strings.HasSuffix(path, "/attempts") {
+			d.ListAttemptsHandler(rec, req)
+		} else {
+			d.GetNotificationHandler(rec, req)
+		}
+		if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "internal-secret") || !strings.Contains(rec.Body.String(), "HTTP 503") {
+			t.Errorf("GET %s: expected the status without the body, got %d: %s", path, rec.Code, rec.Body)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := events.ReceiveTimeout(ctx, time.Second)
+		if err != nil {
+			t.Fatalf("Expected a status event, got %v", err)
+		}
+		if strings.Contains(fmt.Sprint(msg), "internal-secret") {
+			t.Errorf("Expected events without the body, got %v", msg)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// batch.go - bulk scheduling of notifications
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	// maxBatchItems caps the number of notifications in one POST /notify/batch.
+	maxBatchItems = 50000
+	// batchChunkSize is how many notifications are stored and scheduled per round trip.
+	batchChunkSize = 500
+	// maxBatchLine caps the length of one NDJSON line.
+	maxBatchLine = 1 << 20
+)
+
+// BatchItemResult reports the outcome of one item of a batch, by its position in the request.
+type BatchItemResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// BatchStatus aggregates the notifications of a batch.
+type BatchStatus struct {
+	ID     string         `json:"id"`
+	Total  int            `json:"total"`
+	Counts map[string]int `json:"counts"`
+}
+
+// CreateBatch validates every request and schedules the valid ones under a
+// new batch ID, as far as the tenant's quota allows. It returns the batch ID
+// and one result per request.
+func (d *DelayedNotifier) CreateBatch(tenantID string, reqs []NotificationRequest) (string, []BatchItemResult) {
+	batchID := newID()
+	return batchID, d.addToBatch(batchID, tenantID, reqs)
+}
+
+// addToBatch is CreateBatch for a batch that already exists, so that a
+// batch can be created a chunk at a time.
+func (d *DelayedNotifier) addToBatch(batchID, tenantID string, reqs []NotificationRequest) []BatchItemResult {
+	results := make([]BatchItemResult, len(reqs))
+	var valid []*Notification
+	var positions []int
+	for i, req := range reqs {
+		results[i].Index = i
+		if req.Schedule != "" {
+			results[i].Error = "recurring notifications cannot be batched"
+			continue
+		}
+		req.TenantID = tenantID
+		n, err := d.newNotification(req)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		n.BatchID = batchID
+		valid = append(valid, n)
+		positions = append(positions, i)
+	}
+
+	ctx := context.Background()
+	reserved := d.reserveQuota(ctx, tenantID, len(valid))
+	granted := reserved.granted
+	for _, i := range positions[granted:] {
+		results[i].Error = errQuotaExceeded.Error()
+	}
+	valid = valid[:granted]
+	for start := 0; start < len(valid); start += batchChunkSize {
+		end := min(start+batchChunkSize, len(valid))
+		err := d.enqueueMany(ctx, valid[start:end])
+		if err != nil {
+			d.releaseQuota(ctx, reserved, end-start)
+		}
+		for j := start; j < end; j++ {
+			if err != nil {
+				results[positions[j]].Error = err.Error()
+			} else {
+				results[positions[j]].ID = valid[j].ID
+			}
+		}
+	}
+	return results
+}
+
+// enqueueMany is enqueue for many notifications, using one transaction.
+func (d *DelayedNotifier) enqueueMany(ctx context.Context, notifications []*Notification) error {
+	if err := d.store.CreateMany(ctx, notifications); err != nil {
+		return err
+	}
+	for _, n := range notifications {
+		d.recordStatus(ctx, n, "created")
+		scheduledTotal.WithLabelValues(n.Channel).Inc()
+	}
+
+	var err error
+	if bs, ok := d.scheduler.(BatchScheduler); ok {
+		err = bs.ScheduleBatch(ctx, notifications)
+	} else {
+		for _, n := range notifications {
+			if err = d.scheduler.Schedule(ctx, n); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		// The notifications are stored; the outbox relay schedules them later.
+		log.Printf("error scheduling %d notifications, leaving them to the outbox relay: %v", len(notifications), err)
+		return nil
+	}
+	d.markScheduled(ctx, notifications...)
+	return nil
+}
+
+// GetBatch returns how many notifications of a batch of the context's tenant are in each status.
+func (d *DelayedNotifier) GetBatch(ctx context.Context, id string) (*BatchStatus, error) {
+	counts, err := d.store.CountByStatus(ctx, NotificationFilter{TenantID: tenantFrom(ctx), BatchID: id})
+	if err != nil {
+		return nil, err
+	}
+	status := &BatchStatus{ID: id, Counts: counts}
+	for _, c := range counts {
+		status.Total += c
+	}
+	if status.Total == 0 {
+		return nil, fmt.Errorf("batch not found")
+	}
+	return status, nil
+}
+
+// CancelBatch cancels every pending notification of a batch of the context's
+// tenant and returns how many were cancelled.
+func (d *DelayedNotifier) CancelBatch(ctx context.Context, id string) (int, error) {
+	pending, err := d.store.List(ctx, NotificationFilter{TenantID: tenantFrom(ctx), BatchID: id, Status: "pending"})
+	if err != nil {
+		return 0, err
+	}
+	cancelled := 0
+	for _, n := range pending {
+		// A notification may have been claimed by a worker in the meantime.
+		if err := d.CancelNotification(n.ID); err == nil {
+			cancelled++
+		}
+	}
+	return cancelled, nil
+}
+
+// batchItem is one item of a batch body, or why it could not be read.
+type batchItem struct {
+	body createRequest
+	err  error
+}
+
+// readBatch hands the items of a batch body to handle, batchChunkSize at a
+// time. A JSON array is read whole first, so a malformed array is rejected
+// before anything is handled. With an application/x-ndjson content type the
+// body is one JSON object per line and is handled as it streams in; a line
+// that does not parse is an item with an error. The error that stopped the
+// reading may then come after some items were handled.
+func readBatch(r *http.Request, handle func(items []batchItem)) error {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+		return readNDJSONBatch(r.Body, handle)
+	}
+	items, err := readArrayBatch(r.Body)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(items); start += batchChunkSize {
+		handle(items[start:min(start+batchChunkSize, len(items))])
+	}
+	return nil
+}
+
+// readArrayBatch reads the items of a JSON array. Nothing may follow the array.
+func readArrayBatch(body io.Reader) ([]batchItem, error) {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("body must be a JSON array")
+	}
+	var items []batchItem
+	for dec.More() {
+		var item batchItem
+		if err := dec.Decode(&item.body); err != nil {
+			return nil, fmt.Errorf("invalid item %d: %v", len(items), err)
+		}
+		if len(items) == maxBatchItems {
+			return nil, fmt.Errorf("a batch holds at most %d items", maxBatchItems)
+		}
+		items = append(items, item)
+	}
+	if tok, err := dec.Token(); err != nil || tok != json.Delim(']') {
+		return nil, fmt.Errorf("body must be a JSON array")
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON array")
+	}
+	return items, nil
+}
+
+// readNDJSONBatch hands the lines of body to handle as they arrive. Blank
+// lines are skipped.
+func readNDJSONBatch(body io.Reader, handle func(items []batchItem)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchLine)
+	chunk := make([]batchItem, 0, batchChunkSize)
+	read := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if read == maxBatchItems {
+			handle(chunk)
+			return fmt.Errorf("a batch holds at most %d items, the rest was not read", maxBatchItems)
+		}
+		var item batchItem
+		if err := json.Unmarshal(line, &item.body); err != nil {
+			item.err = fmt.Errorf("invalid item %d: %v", read, err)
+		}
+		chunk = append(chunk, item)
+		read++
+		if len(chunk) == batchChunkSize {
+			handle(chunk)
+			chunk = chunk[:0]
+		}
+	}
+	if len(chunk) > 0 {
+		handle(chunk)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read item %d: %v", read, err)
+	}
+	return nil
+}
+
+// CreateBatchHandler handles POST /notify/batch. If reading the body fails
+// after some items were handled, the response reports those items and the
+// error that stopped the reading.
+func (d *DelayedNotifier) CreateBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenantID := tenantFrom(r.Context())
+	batchID := newID()
+	results := []BatchItemResult{}
+	accepted := 0
+	err := readBatch(r, func(items []batchItem) {
+		// Items that do not parse are reported alongside those addToBatch rejects.
+		offset := len(results)
+		var reqs []NotificationRequest
+		var positions []int
+		for i, item := range items {
+			results = append(results, BatchItemResult{Index: offset + i})
+			req, err := NotificationRequest{}, item.err
+			if err == nil {
+				req, err = item.body.request()
+			}
+			if err != nil {
+				results[offset+i].Error = err.Error()
+				continue
+			}
+			reqs = append(reqs, req)
+			positions = append(positions, offset+i)
+		}
+		for j, res := range d.addToBatch(batchID, tenantID, reqs) {
+			res.Index = positions[j]
+			results[res.Index] = res
+			if res.ID != "" {
+				accepted++
+			}
+		}
+	})
+	if err != nil && len(results) == 0 {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]any{
+		"batch_id": batchID,
+		"accepted": accepted,
+		"rejected": len(results) - accepted,
+		"result":   results,
+	}
+	if err != nil {
+		resp["error"] = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// BatchHandler handles GET and DELETE /batches/{id}.
+func (d *DelayedNotifier) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/batches/")
+	switch r.Method {
+	case http.MethodGet:
+		status, err := d.GetBatch(r.Context(), id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]*BatchStatus{"result": status})
+	case http.MethodDelete:
+		if _, err := d.GetBatch(r.Context(), id); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusNotFound)
+			return
+		}
+		cancelled, err := d.CancelBatch(r.Context(), id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"cancelled": cancelled})
+	default:
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
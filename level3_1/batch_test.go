@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateBatchHandler(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+
+	bodies := map[string]string{
+		"application/json": `[
+			{"user_id": "alice", "message": "sale", "channel": "email", "send_at": "2099-01-02T09:00:00Z"},
+			{"user_id": "bob", "message": "sale", "channel": "email", "send_at": "tomorrow"},
+			{"user_id": "carol", "message": "sale", "channel": "email", "send_at": "2000-01-02T09:00:00Z"},
+			{"user_id": "dave", "message": "sale", "channel": "email", "send_at": "2099-01-02T09:00:00Z"}
+		]`,
+		"application/x-ndjson": `{"user_id": "alice", "message": "sale", "channel": "email", "send_at": "2099-01-02T09:00:00Z"}
+{"user_id": "bob", "message": "sale", "channel": "email", "send_at": "tomorrow"}
+{"user_id": "carol", "message": "sale", "channel": "email", "send_at": "2000-01-02T09:00:00Z"}
+{"user_id": "dave", "message": "sale", "channel": "email", "send_at": "2099-01-02T09:00:00Z"}
+`,
+	}
+	for contentType, body := range bodies {
+		req := httptest.NewRequest(http.MethodPost, "/notify/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		d.CreateBatchHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", contentType, rec.Code, rec.Body)
+		}
+
+		var resp struct {
+			BatchID  string            `json:"batch_id"`
+			Accepted int               `json:"accepted"`
+			Rejected int               `json:"rejected"`
+			Result   []BatchItemResult `json:"result"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.Accepted != 2 || resp.Rejected != 2 || len(resp.Result) != 4 {
+			t.Fatalf("%s: unexpected response %+v", contentType, resp)
+		}
+		for i, res := range resp.Result {
+			if res.Index != i || (res.ID == "") == (i == 0 || i == 3) {
+				t.Errorf("%s: unexpected result %+v at %d", contentType, res, i)
+			}
+		}
+		if !strings.Contains(resp.Result[2].Error, "future") {
+			t.Errorf("%s: expected a send_at error, got %q", contentType, resp.Result[2].Error)
+		}
+
+		status, err := d.GetBatch(context.Background(), resp.BatchID)
+		if err != nil || status.Total != 2 || status.Counts["pending"] != 2 {
+			t.Errorf("%s: unexpected batch status %+v (%v)", contentType, status, err)
+		}
+	}
+	if len(broker.deliveries) != 4 {
+		t.Errorf("Expected 4 scheduled notifications, got %d", len(broker.deliveries))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/notify/batch", strings.NewReader(`{"user_id": "alice"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	d.CreateBatchHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a non-array body, got %d", rec.Code)
+	}
+}
+
+func TestCreateBatchHandlerRejectsMalformedArrays(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	item := `{"user_id": "alice", "message": "sale", "channel": "email", "send_at": "2099-01-02T09:00:00Z"}`
+	for _, body := range []string{"[" + item, "[" + item + "}", "[" + item + "] x", "[" + item + "][]"} {
+		req := httptest.NewRequest(http.MethodPost, "/notify/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		d.CreateBatchHandler(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", body, rec.Code, rec.Body)
+		}
+	}
+	if len(broker.deliveries) != 0 {
+		t.Errorf("Expected nothing to be scheduled, got %d", len(broker.deliveries))
+	}
+}
+
+func TestCreateBatchHandlerStreamsNDJSON(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+	// Room for every delivery, so scheduling never blocks.
+	d.scheduler = &fakeBroker{deliveries: make(chan Delivery, 2*batchChunkSize)}
+	line := `{"user_id": "alice", "message": "sale", "channel": "email", "send_at": "2099-01-02T09:00:00Z"}` + "\n"
+
+	body, w := io.Pipe()
+	req := httptest.NewRequest(http.MethodPost, "/notify/batch", body)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		d.CreateBatchHandler(rec, req)
+		close(done)
+	}()
+
+	// The first chunk is created while the rest of the body is still on its way.
+	io.WriteString(w, strings.Repeat(line, batchChunkSize))
+	deadline := time.Now().Add(time.Second)
+	for {
+		list, _ := d.store.List(context.Background(), NotificationFilter{Status: "pending"})
+		if len(list) == batchChunkSize {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d notifications before the body ended, got %d", batchChunkSize, len(list))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	io.WriteString(w, "{not json}\n\n"+line)
+	w.Close()
+	<-done
+
+	var resp struct {
+		Accepted int               `json:"accepted"`
+		Rejected int               `json:"rejected"`
+		Result   []BatchItemResult `json:"result"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Accepted != batchChunkSize+1 || resp.Rejected != 1 || len(resp.Result) != batchChunkSize+2 {
+		t.Fatalf("Unexpected response %d: %d accepted, %d rejected, %d results", rec.Code, resp.Accepted, resp.Rejected, len(resp.Result))
+	}
+	if bad := resp.Result[batchChunkSize]; bad.Index != batchChunkSize || !strings.Contains(bad.Error, "invalid item") {
+		t.Errorf("Expected the malformed line to be rejected, got %+v", bad)
+	}
+	if last := resp.Result[batchChunkSize+1]; last.Index != batchChunkSize+1 || last.ID == "" {
+		t.Errorf("Expected the line after it to be accepted, got %+v", last)
+	}
+}
+
+func TestCancelBatch(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	var reqs []NotificationRequest
+	for _, user := range []string{"alice", "bob", "carol"} {
+		reqs = append(reqs, NotificationRequest{UserID: user, Message: "sale", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	}
+	batchID, _ := d.CreateBatch("", reqs)
+
+	// One notification goes out before the batch is cancelled.
+	d.handleDelivery(<-broker.deliveries)
+
+	rec := httptest.NewRecorder()
+	d.BatchHandler(rec, httptest.NewRequest(http.MethodDelete, "/batches/"+batchID, nil))
+	var resp map[string]any
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp["cancelled"] != float64(2) {
+		t.Fatalf("Expected 2 cancelled, got %d %v", rec.Code, resp)
+	}
+
+	broker.drain(d)
+	if len(sender.sentIDs()) != 1 {
+		t.Errorf("Expected only one notification to be sent, got %v", sender.sentIDs())
+	}
+	status, _ := d.GetBatch(context.Background(), batchID)
+	if status.Counts["sent"] != 1 || status.Counts["cancelled"] != 2 {
+		t.Errorf("Unexpected batch status %+v", status)
+	}
+
+	rec = httptest.NewRecorder()
+	d.BatchHandler(rec, httptest.NewRequest(http.MethodGet, "/batches/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown batch, got %d", rec.Code)
+	}
+}
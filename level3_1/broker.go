@@ -0,0 +1,238 @@
+// broker.go - the queue between the scheduler and the workers
+
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errBrokerDown is returned while the broker cannot take or hand out messages.
+var errBrokerDown = errors.New("broker is not connected")
+
+// Broker carries due notifications to the workers. It keeps one queue per
+// priority lane.
+type Broker interface {
+	// Publish queues body on lane for the workers once delay has passed.
+	// Brokers that cannot hold messages back fail for a positive delay.
+	Publish(ctx context.Context, lane string, body []byte, delay time.Duration) error
+	// Ready returns a channel that is closed while the broker is connected.
+	Ready() <-chan struct{}
+	// Consume registers another competing consumer of lane until ctx is
+	// done. The returned channel is closed when the connection drops; call
+	// Consume again once Ready.
+	Consume(ctx context.Context, lane string) (<-chan Delivery, error)
+	Close() error
+}
+
+// Acknowledger settles a delivery with the broker it came from.
+type Acknowledger interface {
+	// Ack removes the message from the queue.
+	Ack() error
+	// Nack gives the message up, queueing it again for delivery if requeue is set.
+	Nack(requeue bool) error
+}
+
+// Delivery is a message handed to a worker, which must Ack or Nack it.
+type Delivery struct {
+	Body []byte
+	Acknowledger
+}
+
+// MemoryBroker is a Broker that keeps its queues in process memory. It needs
+// no server, which suits tests and single-node development, but queued
+// messages are lost when the process exits.
+type MemoryBroker struct {
+	mu     sync.Mutex
+	lanes  map[string]*memoryLane
+	seq    uint64
+	closed bool
+
+	ready chan struct{}
+	done  chan struct{}
+}
+
+// memoryLane is the queue of one lane of a MemoryBroker.
+type memoryLane struct {
+	messages   memoryQueue
+	wake       chan struct{}
+	deliveries chan Delivery
+}
+
+// NewMemoryBroker creates a MemoryBroker and starts releasing its messages.
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		lanes: make(map[string]*memoryLane, len(lanes)),
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	close(b.ready)
+	for _, l := range lanes {
+		q := &memoryLane{wake: make(chan struct{}, 1), deliveries: make(chan Delivery)}
+		b.lanes[l.priority] = q
+		go b.run(l.priority, q)
+	}
+	return b
+}
+
+// Publish queues body on lane for delivery after delay.
+func (b *MemoryBroker) Publish(ctx context.Context, lane string, body []byte, delay time.Duration) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return errBrokerDown
+	}
+	q, ok := b.lanes[lane]
+	if !ok {
+		b.mu.Unlock()
+		return fmt.Errorf("unknown lane %q", lane)
+	}
+	b.seq++
+	heap.Push(&q.messages, &memoryMessage{body: body, due: time.Now().Add(delay), seq: b.seq})
+	b.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Ready returns a closed channel; the broker is always connected.
+func (b *MemoryBroker) Ready() <-chan struct{} {
+	return b.ready
+}
+
+// Consume returns the delivery channel of lane, which every consumer shares.
+// Nothing is held for a consumer, so ctx has nothing to stop.
+func (b *MemoryBroker) Consume(ctx context.Context, lane string) (<-chan Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, errBrokerDown
+	}
+	q, ok := b.lanes[lane]
+	if !ok {
+		return nil, fmt.Errorf("unknown lane %q", lane)
+	}
+	return q.deliveries, nil
+}
+
+// LaneDepth returns the number of messages on lane that are due but not yet delivered.
+func (b *MemoryBroker) LaneDepth(ctx context.Context, lane string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.lanes[lane]
+	if !ok {
+		return 0, fmt.Errorf("unknown lane %q", lane)
+	}
+	now := time.Now()
+	n := 0
+	for _, m := range q.messages {
+		if !m.due.After(now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Close stops delivering; queued messages are dropped.
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+	return nil
+}
+
+// run hands due messages of a lane, earliest first, to whichever consumer is waiting.
+func (b *MemoryBroker) run(lane string, q *memoryLane) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		var next *memoryMessage
+		wait := time.Hour
+		if len(q.messages) > 0 {
+			if wait = time.Until(q.messages[0].due); wait <= 0 {
+				next = heap.Pop(&q.messages).(*memoryMessage)
+			}
+		}
+		b.mu.Unlock()
+
+		if next != nil {
+			ack := &memoryAcknowledger{broker: b, lane: lane, body: next.body}
+			select {
+			case q.deliveries <- Delivery{Body: next.body, Acknowledger: ack}:
+			case <-b.done:
+				return
+			}
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-b.done:
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// memoryMessage is a message held by a MemoryBroker until it is due.
+type memoryMessage struct {
+	body []byte
+	due  time.Time
+	seq  uint64 // keeps messages due at the same time in publishing order
+}
+
+// memoryQueue is a heap of messages ordered by due time.
+type memoryQueue []*memoryMessage
+
+func (q memoryQueue) Len() int { return len(q) }
+func (q memoryQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+func (q memoryQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *memoryQueue) Push(x any)   { *q = append(*q, x.(*memoryMessage)) }
+func (q *memoryQueue) Pop() any {
+	old := *q
+	m := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return m
+}
+
+// memoryAcknowledger settles a MemoryBroker delivery. A requeued message is
+// due again right away.
+type memoryAcknowledger struct {
+	broker *MemoryBroker
+	lane   string
+	body   []byte
+}
+
+func (a *memoryAcknowledger) Ack() error {
+	return nil
+}
+
+func (a *memoryAcknowledger) Nack(requeue bool) error {
+	if !requeue {
+		return nil
+	}
+	return a.broker.Publish(context.Background(), a.lane, a.body, 0)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// receive waits for the next delivery from msgs.
+func receive(t *testing.T, msgs <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a delivery")
+		return Delivery{}
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx := context.Background()
+	msgs, err := b.Consume(context.Background(), PriorityNormal)
+	if err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	high, err := b.Consume(context.Background(), PriorityHigh)
+	if err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+
+	start := time.Now()
+	b.Publish(ctx, PriorityNormal, []byte("late"), 100*time.Millisecond)
+	b.Publish(ctx, PriorityNormal, []byte("early"), 0)
+	b.Publish(ctx, PriorityHigh, []byte("urgent"), 0)
+	if msg := receive(t, high); string(msg.Body) != "urgent" {
+		t.Fatalf("Expected the message on its own lane, got %s", msg.Body)
+	}
+	if msg := receive(t, msgs); string(msg.Body) != "early" {
+		t.Fatalf("Expected the undelayed message first, got %s", msg.Body)
+	}
+	msg := receive(t, msgs)
+	if string(msg.Body) != "late" || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("Expected the delayed message after its delay, got %s after %s", msg.Body, time.Since(start))
+	}
+
+	// A requeued message comes back; a rejected one does not.
+	msg.Nack(true)
+	msg = receive(t, msgs)
+	if string(msg.Body) != "late" {
+		t.Fatalf("Expected the requeued message, got %s", msg.Body)
+	}
+	msg.Nack(false)
+	select {
+	case msg := <-msgs:
+		t.Fatalf("Expected no more deliveries, got %s", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Close()
+	if err := b.Publish(ctx, PriorityNormal, []byte("closed"), 0); err != errBrokerDown {
+		t.Errorf("Expected errBrokerDown after Close, got %v", err)
+	}
+}
+
+// flakySender fails the first send of every notification.
+type flakySender struct {
+	mu     sync.Mutex
+	failed map[string]bool
+}
+
+func (s *flakySender) Send(ctx context.Context, notification *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.failed[notification.ID] {
+		s.failed[notification.ID] = true
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+// waitForStatus waits until the notification reaches status.
+func waitForStatus(t *testing.T, d *DelayedNotifier, id, status string) *Notification {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, err := d.store.Get(context.Background(), id)
+		if err == nil && n.Status == status {
+			return n
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be %s, got %+v (%v)", id, status, n, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWorkersOnMemoryBroker(t *testing.T) {
+	d, _, sender := newTestNotifier(t)
+	broker := NewMemoryBroker()
+	defer broker.Close()
+	d.broker = broker
+	d.scheduler = NewBrokerScheduler(broker)
+	d.senders.Register("telegram", &flakySender{failed: map[string]bool{}})
+	d.retryPolicies = map[string]RetryPolicy{"telegram": {MaxAttempts: 3, BaseDelay: 20 * time.Millisecond, MaxDelay: 20 * time.Millisecond}}
+	d.startWorkers(broker, 2)
+	defer stopWorkers(d)
+
+	sendAt := time.Now().Add(150 * time.Millisecond)
+	email, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: sendAt})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	telegram, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "telegram", SendAt: time.Now().Add(50 * time.Millisecond)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+
+	n := waitForStatus(t, d, email, "sent")
+	if n.SentAt == nil || n.SentAt.Before(sendAt) {
+		t.Errorf("Expected %s to be sent after %s, got %v", email, sendAt, n.SentAt)
+	}
+	if sent := sender.sentIDs(); len(sent) != 1 || sent[0] != email {
+		t.Errorf("Expected %s to be sent once, got %v", email, sent)
+	}
+	// The failed attempt goes back through the broker with the retry delay.
+	if n := waitForStatus(t, d, telegram, "sent"); n.Retries != 1 {
+		t.Errorf("Expected %s to be sent on the first retry, got %d retries", telegram, n.Retries)
+	}
+}
+
+func TestNewDelayedNotifierOnMemoryBroker(t *testing.T) {
+	mr := miniredis.RunT(t)
+	// Each scheduler gets a notifier of its own, which also shows that a
+	// second notifier in the same process can be built. The last one runs
+	// without any outside service.
+	for _, tt := range []struct{ redisAddr, scheduler string }{
+		{mr.Addr(), "redis"},
+		{mr.Addr(), "broker"},
+		{MemoryRedis, "redis"},
+	} {
+		t.Run(tt.redisAddr+"/"+tt.scheduler, func(t *testing.T) {
+			sender := &recordingSender{}
+			senders := NewSenderRegistry()
+			senders.Register("email", sender)
+			d, err := NewDelayedNotifier(Config{
+				RedisAddr: tt.redisAddr,
+				Store:     NewMemoryStore(),
+				Broker:    "memory",
+				Scheduler: tt.scheduler,
+				Senders:   senders,
+				Workers:   2,
+			})
+			if err != nil {
+				t.Fatalf("NewDelayedNotifier failed: %v", err)
+			}
+
+			sendAt := time.Now().Add(50 * time.Millisecond)
+			id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: sendAt})
+			if err != nil {
+				t.Fatalf("CreateNotification failed: %v", err)
+			}
+			n := waitForStatus(t, d, id, "sent")
+			if n.SentAt == nil || n.SentAt.Before(sendAt) {
+				t.Errorf("Expected %s to be sent after %s, got %v", id, sendAt, n.SentAt)
+			}
+			if sent := sender.sentIDs(); len(sent) != 1 || sent[0] != id {
+				t.Errorf("Expected %s to be sent once, got %v", id, sent)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := d.Shutdown(ctx); err != nil {
+				t.Errorf("Shutdown failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// dlq.go - dead-letter handling for notifications that exhausted their retries
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeadLetter records a notification that could not be delivered.
+type DeadLetter struct {
+	NotificationID string        `json:"notification_id"`
+	Error          string        `json:"error"`
+	FailedAt       time.Time     `json:"failed_at"`
+	Notification   *Notification `json:"notification,omitempty"`
+}
+
+// deadLetter marks the claimed notification as failed and moves it to the
+// dead-letter table. It reports false if the claim was lost before.
+func (d *DelayedNotifier) deadLetter(ctx context.Context, notification *Notification, sendErr error) bool {
+	notification.Status = "failed"
+	notification.LastError = sendErr.Error()
+	if !d.saveNotification(notification) {
+		return false
+	}
+	d.recordStatus(ctx, notification, sendErr.Error())
+
+	dl := &DeadLetter{
+		NotificationID: notification.ID,
+		Error:          sendErr.Error(),
+		FailedAt:       d.now(),
+	}
+	if err := d.store.AddDeadLetter(ctx, dl); err != nil {
+		log.Printf("error dead-lettering notification %s: %v", notification.ID, err)
+	}
+	return true
+}
+
+// ListDeadLetters returns every dead-lettered notification, oldest first.
+func (d *DelayedNotifier) ListDeadLetters() ([]*DeadLetter, error) {
+	return d.store.ListDeadLetters(context.Background())
+}
+
+// ReplayDeadLetter schedules a dead-lettered notification for immediate delivery
+// with a fresh retry budget.
+func (d *DelayedNotifier) ReplayDeadLetter(id string) error {
+	ctx := context.Background()
+	notification, err := d.store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if notification.Status != "failed" {
+		return fmt.Errorf("notification is %s, only failed notifications can be replayed", notification.Status)
+	}
+
+	notification.Status = "pending"
+	notification.Retries = 0
+	notification.SendAt = d.now()
+	if err := d.store.Update(ctx, notification); err != nil {
+		return err
+	}
+	if err := d.scheduler.Schedule(ctx, notification); err != nil {
+		notification.Status = "failed"
+		if err := d.store.Update(ctx, notification); err != nil {
+			log.Printf("error saving notification %s: %v", notification.ID, err)
+		}
+		return fmt.Errorf("failed to schedule notification: %v", err)
+	}
+	d.recordStatus(ctx, notification, "replayed from the dead-letter queue")
+
+	if err := d.store.RemoveDeadLetter(ctx, id); err != nil && err != ErrNotFound {
+		log.Printf("error removing dead letter %s: %v", id, err)
+	}
+	return nil
+}
+
+// ListDeadLettersHandler handles GET /admin/dlq.
+func (d *DelayedNotifier) ListDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	letters, err := d.ListDeadLetters()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*DeadLetter{"result": letters})
+}
+
+// ReplayDeadLetterHandler handles POST /admin/dlq/{id}/replay.
+func (d *DelayedNotifier) ReplayDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/admin/dlq/")
+	id, ok := strings.CutSuffix(path, "/replay")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		http.Error(w, `{"error": "not found"}`, http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := d.ReplayDeadLetter(id); err != nil {
+		status := http.StatusConflict
+		if err == ErrNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"result": "replayed"})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// failingSender always returns err.
+type failingSender struct {
+	err error
+}
+
+func (s failingSender) Send(ctx context.Context, notification *Notification) error {
+	return s.err
+}
+
+func TestExhaustedNotificationIsDeadLetteredAndReplayed(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	d.senders.Register("email", failingSender{err: errors.New("mailbox unavailable")})
+
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	broker.drain(d)
+
+	letters, err := d.ListDeadLetters()
+	if err != nil {
+		t.Fatalf("ListDeadLetters failed: %v", err)
+	}
+	if len(letters) != 1 || letters[0].NotificationID != id || letters[0].Error != "mailbox unavailable" {
+		t.Fatalf("Unexpected dead letters %+v", letters)
+	}
+	if letters[0].Notification.Status != "failed" || letters[0].Notification.Retries != 3 {
+		t.Errorf("Unexpected notification %+v", letters[0].Notification)
+	}
+
+	// The provider recovers and on-call replays the notification.
+	d.senders.Register("email", sender)
+	srv := httptest.NewServer(http.HandlerFunc(d.ReplayDeadLetterHandler))
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/admin/dlq/"+id+"/replay", "", nil)
+	if err != nil {
+		t.Fatalf("replay request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	broker.drain(d)
+
+	if status, _ := d.GetNotificationStatus(id); status != "sent" {
+		t.Errorf("Expected replayed notification to be sent, got %s", status)
+	}
+	if letters, _ := d.ListDeadLetters(); len(letters) != 0 {
+		t.Errorf("Expected empty dead-letter list, got %d", len(letters))
+	}
+	if err := d.ReplayDeadLetter(id); err == nil {
+		t.Error("ReplayDeadLetter should fail for a sent notification")
+	}
+}
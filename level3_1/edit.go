@@ -0,0 +1,175 @@
+// edit.go - changing pending notifications
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// errNotPending is returned when editing a notification that is being sent or has finished.
+	errNotPending = errors.New("notification is not pending")
+	// errVersionConflict is returned when a notification changed since the version the caller saw.
+	errVersionConflict = errors.New("notification was changed by another request")
+)
+
+// NotificationPatch lists the changes to a pending notification. Nil fields are left alone.
+type NotificationPatch struct {
+	Message  *string
+	Channel  *string
+	Target   *string
+	SendAt   *time.Time
+	Timezone *string
+	// Version, when not zero, is the version the caller last saw; the edit
+	// fails with errVersionConflict if the notification changed since.
+	Version int
+}
+
+// UpdateNotification applies patch to a pending notification and schedules
+// it again under a new version. Copies queued before the edit fail the
+// version check in the worker, so only the latest version is delivered.
+func (d *DelayedNotifier) UpdateNotification(id string, patch NotificationPatch) (*Notification, error) {
+	ctx := context.Background()
+	n, err := d.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if n.Status != "pending" {
+		return nil, errNotPending
+	}
+	if patch.Version != 0 && patch.Version != n.Version {
+		return nil, errVersionConflict
+	}
+
+	var changed []string
+	if patch.Message != nil {
+		if n.TemplateID != "" {
+			return nil, fmt.Errorf("the message of a templated notification is rendered at send time")
+		}
+		n.Message = *patch.Message
+		changed = append(changed, "message")
+	}
+	if patch.Channel != nil {
+		n.Channel = *patch.Channel
+		changed = append(changed, "channel")
+	}
+	if patch.Target != nil {
+		n.Target = *patch.Target
+		changed = append(changed, "target")
+	}
+	if patch.Timezone != nil {
+		if _, err := loadLocation(*patch.Timezone); err != nil {
+			return nil, err
+		}
+		n.Timezone = *patch.Timezone
+		changed = append(changed, "timezone")
+	}
+	if patch.SendAt != nil {
+		if patch.SendAt.Before(d.now()) {
+			return nil, fmt.Errorf("send_at must be in the future")
+		}
+		n.SendAt, n.OriginalSendAt = *patch.SendAt, *patch.SendAt
+		changed = append(changed, "send_at")
+	}
+	if len(changed) == 0 {
+		return nil, fmt.Errorf("nothing to change")
+	}
+	if err := d.validateTarget(n.Channel, n.Target); err != nil {
+		return nil, err
+	}
+
+	// The store only accepts the edit while the notification is still pending
+	// at the version read above, so a concurrent claim, cancel or edit wins.
+	version := n.Version
+	n.Version++
+	if err := d.store.UpdatePending(ctx, n, version); err == ErrStatusConflict {
+		if current, err := d.store.Get(ctx, id); err == nil && current.Status != "pending" {
+			return nil, errNotPending
+		}
+		return nil, errVersionConflict
+	} else if err != nil {
+		return nil, err
+	}
+	d.recordStatus(ctx, n, fmt.Sprintf("edited %s (version %d)", strings.Join(changed, ", "), n.Version))
+
+	if err := d.scheduler.Schedule(ctx, n); err != nil {
+		log.Printf("error scheduling notification %s, leaving it to the outbox relay: %v", n.ID, err)
+	} else {
+		d.markScheduled(ctx, n)
+	}
+	localize(n)
+	return n, nil
+}
+
+// patchRequest is the JSON body of PATCH /notify/{id}.
+type patchRequest struct {
+	Message  *string `json:"message"`
+	Channel  *string `json:"channel"`
+	Target   *string `json:"target"`
+	SendAt   *string `json:"send_at"`
+	Timezone *string `json:"timezone"`
+	Version  int     `json:"version"`
+}
+
+// UpdateNotificationHandler handles PATCH /notify/{id}.
+func (d *DelayedNotifier) UpdateNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/notify/")
+	if _, err := d.ownNotification(r.Context(), id); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusNotFound)
+		return
+	}
+	var body patchRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, `{"error": "invalid JSON body"}`, http.StatusBadRequest)
+		return
+	}
+	patch := NotificationPatch{
+		Message:  body.Message,
+		Channel:  body.Channel,
+		Target:   body.Target,
+		Timezone: body.Timezone,
+		Version:  body.Version,
+	}
+	if body.SendAt != nil {
+		// send_at without an offset is read in the new timezone, or else the notification's own.
+		timezone := ""
+		if body.Timezone != nil {
+			timezone = *body.Timezone
+		} else if n, err := d.store.Get(context.Background(), id); err == nil {
+			timezone = n.Timezone
+		}
+		sendAt, err := parseSendAt(*body.SendAt, timezone)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		patch.SendAt = &sendAt
+	}
+
+	notification, err := d.UpdateNotification(id, patch)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == ErrNotFound {
+			status = http.StatusNotFound
+		} else if err == errNotPending || err == errVersionConflict {
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]*Notification{"result": notification})
+}
@@ -0,0 +1,119 @@
+// events.go - status events over Redis pub/sub and Server-Sent Events
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// eventKeepAlive is how often an idle event stream sends a comment, so that
+// proxies do not close it.
+const eventKeepAlive = 15 * time.Second
+
+// StatusEvent announces that a notification entered a status.
+type StatusEvent struct {
+	NotificationID string    `json:"notification_id"`
+	UserID         string    `json:"user_id"`
+	Channel        string    `json:"channel"`
+	Status         string    `json:"status"`
+	Reason         string    `json:"reason,omitempty"`
+	At             time.Time `json:"at"`
+}
+
+// name returns the SSE event name. A pending notification is waiting for its
+// send_at, so it is announced as scheduled.
+func (e StatusEvent) name() string {
+	if e.Status == "pending" {
+		return "scheduled"
+	}
+	return e.Status
+}
+
+// eventsKey is the Redis pub/sub channel carrying the events of a tenant's user.
+func eventsKey(tenantID, userID string) string {
+	return "notifications:events:" + tenantID + ":" + userID
+}
+
+// publishEvent publishes a status change to the subscribers of the
+// notification's user, on this and every other notifier instance.
+func (d *DelayedNotifier) publishEvent(ctx context.Context, notification *Notification, change StatusChange) {
+	if notification.UserID == "" {
+		return
+	}
+	body, err := json.Marshal(StatusEvent{
+		NotificationID: notification.ID,
+		UserID:         notification.UserID,
+		Channel:        notification.Channel,
+		Status:         change.Status,
+		Reason:         change.Reason,
+		At:             change.At,
+	})
+	if err != nil {
+		return
+	}
+	if err := d.redis.Publish(ctx, eventsKey(notification.TenantID, notification.UserID), body).Err(); err != nil {
+		log.Printf("error publishing event of notification %s: %v", notification.ID, err)
+	}
+}
+
+// EventsHandler handles GET /notify/events?user_id=, streaming the status
+// events of the tenant's user as Server-Sent Events until the client disconnects.
+func (d *DelayedNotifier) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, `{"error": "user_id is required"}`, http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `{"error": "streaming is not supported"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	sub := d.redis.Subscribe(ctx, eventsKey(tenantFrom(ctx), userID))
+	defer sub.Close()
+	// Wait for the subscription to be confirmed so no event is missed once the response starts.
+	if _, err := sub.Receive(ctx); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := sub.Channel()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case msg, ok := <-events:
+			if !ok {
+				return
+			}
+			var event StatusEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("error decoding event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name(), msg.Payload)
+		}
+		flusher.Flush()
+	}
+}
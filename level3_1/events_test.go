@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads the next event from an SSE stream, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (string, StatusEvent) {
+	t.Helper()
+	var name string
+	var event StatusEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatalf("invalid event data %q: %v", line, err)
+			}
+		case line == "" && name != "":
+			return name, event
+		}
+	}
+}
+
+func TestEventsHandlerStreamsStatusChanges(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	srv := httptest.NewServer(http.HandlerFunc(d.EventsHandler))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/notify/events?user_id=alice")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	stream := bufio.NewReader(resp.Body)
+
+	sendAt := time.Now().Add(time.Hour)
+	// Events of other users are not part of the stream.
+	if _, err := d.CreateNotification(NotificationRequest{UserID: "bob", Message: "hi", Channel: "email", SendAt: sendAt}); err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	<-broker.deliveries
+	sent, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: sendAt})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	d.handleDelivery(<-broker.deliveries)
+	cancelled, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "bye", Channel: "email", SendAt: sendAt})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	if err := d.CancelNotification(cancelled); err != nil {
+		t.Fatalf("CancelNotification failed: %v", err)
+	}
+
+	want := []struct{ name, id string }{
+		{"scheduled", sent},
+		{"sending", sent},
+		{"sent", sent},
+		{"scheduled", cancelled},
+		{"cancelled", cancelled},
+	}
+	for _, w := range want {
+		name, event := readEvent(t, stream)
+		if name != w.name || event.NotificationID != w.id || event.UserID != "alice" {
+			t.Fatalf("Expected %s of %s, got %s %+v", w.name, w.id, name, event)
+		}
+	}
+}
+
+func TestEventsHandlerRequiresUser(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+	rec := httptest.NewRecorder()
+	d.EventsHandler(rec, httptest.NewRequest(http.MethodGet, "/notify/events", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateNotificationHandlerJSON(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+
+	body := `{"user_id": "alice", "message": "hi", "channel": "email", "send_at": "2099-01-02T09:00:00", "timezone": "Asia/Almaty", "priority": "high"}`
+	req := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	d.CreateNotificationHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var created map[string]string
+	json.NewDecoder(rec.Body).Decode(&created)
+
+	rec = httptest.NewRecorder()
+	d.GetNotificationHandler(rec, httptest.NewRequest(http.MethodGet, "/notify/"+created["result"], nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var got struct {
+		Result Notification `json:"result"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	n := got.Result
+	if n.UserID != "alice" || n.Status != "pending" || n.Timezone != "Asia/Almaty" || n.Priority != PriorityHigh || n.CreatedAt.IsZero() {
+		t.Errorf("Unexpected notification %+v", n)
+	}
+	if want := time.Date(2099, 1, 2, 4, 0, 0, 0, time.UTC); !n.SendAt.Equal(want) {
+		t.Errorf("Expected send_at %v, got %v", want, n.SendAt)
+	}
+	if _, offset := n.SendAt.Zone(); offset != 5*60*60 {
+		t.Errorf("Expected send_at in the notification timezone, got %v", n.SendAt)
+	}
+
+	broker.drain(d)
+	rec = httptest.NewRecorder()
+	d.GetNotificationHandler(rec, httptest.NewRequest(http.MethodGet, "/notify/"+n.ID, nil))
+	got.Result = Notification{}
+	json.NewDecoder(rec.Body).Decode(&got)
+	if got.Result.Status != "sent" || got.Result.SentAt == nil || got.Result.LastAttemptAt == nil {
+		t.Errorf("Expected sent notification with delivery timestamps, got %+v", got.Result)
+	}
+}
+
+func TestCreateNotificationHandlerForm(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+
+	cases := []struct {
+		userID string
+		sendAt string
+		want   int
+	}{
+		{"bob", "2099-01-02 09:00:00", http.StatusOK},
+		{"carol", "2099-01-02T09:00:00+03:00", http.StatusOK},
+		{"dave", "02.01.2099 09:00", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		form := url.Values{"user_id": {c.userID}, "message": {"hi"}, "channel": {"email"}, "send_at": {c.sendAt}}
+		req := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		d.CreateNotificationHandler(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("send_at %q: expected %d, got %d: %s", c.sendAt, c.want, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestCreateNotificationHandlerValidationErrors(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+	store := &brokenStore{MemoryStore: NewMemoryStore()}
+	d.store = store
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		d.CreateNotificationHandler(rec, req)
+		return rec
+	}
+	for name, body := range map[string]string{
+		"past send_at": `{"user_id": "alice", "message": "hi", "channel": "email", "send_at": "2000-01-02T09:00:00Z"}`,
+		"bad send_at":  `{"user_id": "alice", "message": "hi", "channel": "email", "send_at": "tomorrow"}`,
+		"bad timezone": `{"user_id": "alice", "message": "hi", "channel": "email", "send_at": "2099-01-02T09:00:00", "timezone": "Mars/Olympus"}`,
+		"bad priority": `{"user_id": "alice", "message": "hi", "channel": "email", "send_at": "2099-01-02T09:00:00Z", "priority": "urgent"}`,
+		"no template":  `{"user_id": "alice", "template_id": "missing", "channel": "email", "send_at": "2099-01-02T09:00:00Z"}`,
+		"bad schedule": `{"user_id": "alice", "message": "hi", "channel": "email", "schedule": "every day"}`,
+	} {
+		if rec := post(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", name, rec.Code, rec.Body)
+		}
+	}
+
+	// Failures on the server side stay 500s.
+	store.broken = true
+	if rec := post(`{"user_id": "alice", "message": "hi", "channel": "email", "send_at": "2099-01-02T09:00:00Z"}`); rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when the store is down, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestListNotificationsHandlerPages(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+	sendAt := time.Now().Add(time.Hour)
+	for _, user := range []string{"alice", "alice", "bob"} {
+		d.store.Create(context.Background(), &Notification{
+			ID: fmt.Sprintf("%s-%d", user, sendAt.UnixNano()), UserID: user, Channel: "email",
+			SendAt: sendAt, Status: "pending", CreatedAt: time.Now(),
+		})
+		sendAt = sendAt.Add(time.Minute)
+	}
+
+	var page struct {
+		Result     []Notification `json:"result"`
+		NextCursor string         `json:"next_cursor"`
+	}
+	var ids []string
+	path := "/notify?user_id=alice&status=pending&limit=1"
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		d.ListNotificationsHandler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		page.NextCursor = ""
+		json.NewDecoder(rec.Body).Decode(&page)
+		for _, n := range page.Result {
+			ids = append(ids, n.UserID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		path = "/notify?user_id=alice&status=pending&limit=1&cursor=" + page.NextCursor
+	}
+	if strings.Join(ids, " ") != "alice alice" {
+		t.Errorf("Expected two pages of alice, got %v", ids)
+	}
+
+	rec := httptest.NewRecorder()
+	d.ListNotificationsHandler(rec, httptest.NewRequest(http.MethodGet, "/notify?cursor=bogus", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid cursor, got %d", rec.Code)
+	}
+}
+
+func TestCreateNotificationHandlerIdempotencyKey(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	post := func(key string) (int, string, http.Header) {
+		body := `{"user_id": "alice", "message": "hi", "channel": "email", "send_at": "2099-01-02T09:00:00Z"}`
+		req := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		d.CreateNotificationHandler(rec, req)
+		var created map[string]string
+		json.NewDecoder(rec.Body).Decode(&created)
+		return rec.Code, created["result"], rec.Header()
+	}
+
+	_, first, _ := post("key-1")
+	code, again, header := post("key-1")
+	if code != http.StatusOK || again != first || header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the retry to return %s, got %d %s", first, code, again)
+	}
+	_, other, _ := post("key-2")
+	_, unkeyed, _ := post("")
+	if other == first || unkeyed == first || other == unkeyed {
+		t.Errorf("Expected distinct IDs, got %s, %s and %s", first, other, unkeyed)
+	}
+	if len(broker.deliveries) != 3 {
+		t.Errorf("Expected 3 scheduled notifications, got %d", len(broker.deliveries))
+	}
+}
+
+func TestNewIDIsUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := newID()
+		if len(id) != 36 || id[14] != '4' || seen[id] {
+			t.Fatalf("Unexpected or duplicate ID %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestUpdateNotificationHandlerReschedules(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	id, err := d.CreateNotification(NotificationRequest{UserID: "patch-user", Message: "old", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	stale := <-broker.deliveries
+
+	patch := func(body string) (*httptest.ResponseRecorder, Notification) {
+		req := httptest.NewRequest(http.MethodPatch, "/notify/"+id, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		d.UpdateNotificationHandler(rec, req)
+		var resp struct {
+			Result Notification `json:"result"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec, resp.Result
+	}
+
+	sendAt := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+	rec, n := patch(`{"message": "new", "send_at": "` + sendAt.Format(time.RFC3339) + `", "version": 1}`)
+	if rec.Code != http.StatusOK || n.Message != "new" || n.Version != 2 || !n.SendAt.Equal(sendAt) {
+		t.Fatalf("Expected the edited notification, got %d %+v", rec.Code, n)
+	}
+	if rec, _ := patch(`{"message": "newer", "version": 1}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for an edit of an old version, got %d", rec.Code)
+	}
+	if rec, _ := patch(`{"send_at": "2001-01-01T00:00:00Z"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a past send_at, got %d", rec.Code)
+	}
+
+	// The copy queued before the edit is dropped; only the new version goes out.
+	d.handleDelivery(stale)
+	if len(sender.sentIDs()) != 0 {
+		t.Fatal("The stale copy was delivered")
+	}
+	d.handleDelivery(<-broker.deliveries)
+	got, _ := d.GetNotification(id)
+	if got.Status != "sent" || got.Message != "new" || len(sender.sentIDs()) != 1 {
+		t.Errorf("Expected the new version to be sent once, got %+v", got)
+	}
+	if rec, _ := patch(`{"message": "late"}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a sent notification, got %d", rec.Code)
+	}
+}
+
+func TestListAttemptsHandler(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	d.senders.Register("telegram", &flakySender{failed: map[string]bool{}})
+
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "telegram", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	// The first attempt fails and is retried; the retry succeeds.
+	d.handleDelivery(<-broker.deliveries)
+	d.handleDelivery(<-broker.deliveries)
+
+	rec := httptest.NewRecorder()
+	d.ListAttemptsHandler(rec, httptest.NewRequest(http.MethodGet, "/notify/"+id+"/attempts", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var got struct {
+		Result []DeliveryAttempt `json:"result"`
+	}
+	json.NewDecoder(rec.Body).Decode(&got)
+	if len(got.Result) != 2 || got.Result[0].Attempt != 1 || got.Result[0].Error != "unavailable" ||
+		got.Result[1].Attempt != 2 || got.Result[1].Error != "" || got.Result[1].Channel != "telegram" {
+		t.Errorf("Unexpected attempts %+v", got.Result)
+	}
+
+	rec = httptest.NewRecorder()
+	d.ListAttemptsHandler(rec, httptest.NewRequest(http.MethodGet, "/notify/missing/attempts", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,26 @@
+// history.go - status history of notifications
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// StatusChange records a notification entering a status and why.
+type StatusChange struct {
+	Status string    `json:"status"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// recordStatus appends the notification's current status to its history and
+// publishes it to the user's event stream.
+func (d *DelayedNotifier) recordStatus(ctx context.Context, notification *Notification, reason string) {
+	change := StatusChange{Status: notification.Status, Reason: reason, At: d.now()}
+	if err := d.store.AddStatusChange(ctx, notification.ID, change); err != nil {
+		log.Printf("error recording status of notification %s: %v", notification.ID, err)
+	}
+	d.publishEvent(ctx, notification, change)
+}
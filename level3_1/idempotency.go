@@ -0,0 +1,101 @@
+// idempotency.go - collision-free IDs and Idempotency-Key handling
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// IdempotencyKeyHeader lets clients retry POST requests without creating duplicates.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// idempotencyTTL is how long a key is remembered.
+	idempotencyTTL = 24 * time.Hour
+	// idempotencyPending marks a key whose first request is still being processed.
+	idempotencyPending = "pending"
+)
+
+// errIdempotencyInProgress is returned while the first request with a key has not finished.
+var errIdempotencyInProgress = errors.New("a request with this Idempotency-Key is still in progress")
+
+// newID returns a random RFC 4122 version 4 UUID.
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// idempotencyKey returns the request's Idempotency-Key, scoped to its tenant
+// so that tenants never see each other's results.
+func idempotencyKey(r *http.Request) string {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if tenant := tenantFrom(r.Context()); key != "" && tenant != "" {
+		return tenant + ":" + key
+	}
+	return key
+}
+
+// idempotent runs create at most once per key and returns its result. A repeated
+// key returns the stored result with replayed set. An empty key always runs create.
+// If create fails the key is released so the client can retry.
+func (d *DelayedNotifier) idempotent(key string, create func() (map[string]string, error)) (result map[string]string, replayed bool, err error) {
+	if key == "" {
+		result, err = create()
+		return result, false, err
+	}
+
+	ctx := context.Background()
+	redisKey := "notifications:idempotency:" + key
+	claimed, err := d.redis.SetNX(ctx, redisKey, idempotencyPending, idempotencyTTL).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to check idempotency key: %v", err)
+	}
+	if !claimed {
+		stored, err := d.redis.Get(ctx, redisKey).Result()
+		if err == redis.Nil {
+			// The first request failed and released the key in the meantime.
+			return d.idempotent(key, create)
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to check idempotency key: %v", err)
+		}
+		if stored == idempotencyPending {
+			return nil, false, errIdempotencyInProgress
+		}
+		if err := json.Unmarshal([]byte(stored), &result); err != nil {
+			return nil, false, fmt.Errorf("corrupt idempotency record: %v", err)
+		}
+		return result, true, nil
+	}
+
+	result, err = create()
+	if err != nil {
+		d.redis.Del(ctx, redisKey)
+		return nil, false, err
+	}
+	body, _ := json.Marshal(result)
+	if err := d.redis.Set(ctx, redisKey, body, idempotencyTTL).Err(); err != nil {
+		log.Printf("error storing idempotency key %s: %v", key, err)
+	}
+	return result, false, nil
+}
+
+// writeIdempotent writes a create response, flagging replays of an earlier request.
+func writeIdempotent(w http.ResponseWriter, result map[string]string, replayed bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	json.NewEncoder(w).Encode(result)
+}
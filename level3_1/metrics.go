@@ -0,0 +1,177 @@
+// metrics.go - Prometheus metrics and health endpoints
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	scheduledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_scheduled_total",
+		Help: "Notifications accepted and handed to the scheduler.",
+	}, []string{"channel"})
+	sentTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_sent_total",
+		Help: "Notifications delivered successfully.",
+	}, []string{"channel"})
+	failedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_failed_total",
+		Help: "Notifications that failed for good and went to the dead-letter queue.",
+	}, []string{"channel"})
+	retriedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_retried_total",
+		Help: "Failed delivery attempts that were scheduled for a retry.",
+	}, []string{"channel"})
+	cancelledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_cancelled_total",
+		Help: "Notifications cancelled before delivery.",
+	}, []string{"channel"})
+	sendLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "notifications_send_lag_seconds",
+		Help:    "Time between a notification's original send_at and its delivery.",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600},
+	}, []string{"channel"})
+	laneDeliveredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_lane_delivered_total",
+		Help: "Deliveries taken off a priority lane by the workers.",
+	}, []string{"lane"})
+	laneWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "notifications_lane_wait_seconds",
+		Help:    "Time between a notification's send_at and a worker taking it off its lane.",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600},
+	}, []string{"lane"})
+)
+
+// DepthReporter is implemented by schedulers that can count the notifications they hold.
+type DepthReporter interface {
+	Depth(ctx context.Context) (int, error)
+}
+
+// LaneDepthReporter is implemented by brokers that can count the due
+// notifications waiting on a lane.
+type LaneDepthReporter interface {
+	LaneDepth(ctx context.Context, lane string) (int, error)
+}
+
+// queueDepthCollector reports, at scrape time, how many notifications wait
+// in the scheduler for their send_at and how many are due and wait in the
+// broker, in total and per lane.
+type queueDepthCollector struct {
+	d        *DelayedNotifier
+	desc     *prometheus.Desc
+	laneDesc *prometheus.Desc
+}
+
+func newQueueDepthCollector(d *DelayedNotifier) *queueDepthCollector {
+	return &queueDepthCollector{
+		d:        d,
+		desc:     prometheus.NewDesc("notifications_queue_depth", "Notifications waiting in a queue.", []string{"queue"}, nil),
+		laneDesc: prometheus.NewDesc("notifications_lane_depth", "Due notifications waiting on a priority lane.", []string{"lane"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+	ch <- c.laneDesc
+}
+
+// Collect implements prometheus.Collector. Queues that cannot be inspected are left out.
+func (c *queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if r, ok := c.d.scheduler.(DepthReporter); ok {
+		if n, err := r.Depth(ctx); err != nil {
+			log.Printf("error measuring scheduled notifications: %v", err)
+		} else {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), "scheduled")
+		}
+	}
+	if r, ok := c.d.broker.(LaneDepthReporter); ok {
+		total, complete := 0, true
+		for _, l := range lanes {
+			n, err := r.LaneDepth(ctx, l.priority)
+			if err != nil {
+				log.Printf("error measuring due notifications on lane %s: %v", l.priority, err)
+				complete = false
+				continue
+			}
+			total += n
+			ch <- prometheus.MustNewConstMetric(c.laneDesc, prometheus.GaugeValue, float64(n), l.priority)
+		}
+		if complete {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(total), "due")
+		}
+	}
+}
+
+// checkHealth checks the connections to Redis and the broker and returns the
+// result of each check, "ok" or the error.
+func (d *DelayedNotifier) checkHealth(ctx context.Context) (map[string]string, bool) {
+	checks := map[string]string{"redis": "ok", "broker": "ok"}
+	healthy := true
+	if err := d.redis.Ping(ctx).Err(); err != nil {
+		checks["redis"] = err.Error()
+		healthy = false
+	}
+	if !d.brokerReady() {
+		checks["broker"] = errBrokerDown.Error()
+		healthy = false
+	}
+	return checks, healthy
+}
+
+// brokerReady reports whether the broker is connected.
+func (d *DelayedNotifier) brokerReady() bool {
+	if d.broker == nil {
+		return false
+	}
+	select {
+	case <-d.broker.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+// writeHealth writes the result of checkHealth, failing with 503 if required and a check failed.
+func (d *DelayedNotifier) writeHealth(w http.ResponseWriter, r *http.Request, required bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	checks, healthy := d.checkHealth(ctx)
+	status := "ok"
+	if !healthy {
+		status = "degraded"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if required && !healthy {
+		status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": checks})
+}
+
+// HealthzHandler handles GET /healthz. It succeeds while the process is
+// serving, reporting lost dependencies as degraded, so that an outage of
+// Redis or the broker does not get the notifier restarted.
+func (d *DelayedNotifier) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	d.writeHealth(w, r, false)
+}
+
+// ReadyzHandler handles GET /readyz. It fails with 503 unless Redis and the broker are reachable.
+func (d *DelayedNotifier) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	d.writeHealth(w, r, true)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeliveryMetrics(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	d.senders.Register("telegram", failingSender{err: errors.New("unavailable")})
+	d.retryPolicies = map[string]RetryPolicy{"telegram": {MaxAttempts: 2}}
+
+	scheduled := testutil.ToFloat64(scheduledTotal.WithLabelValues("email"))
+	sent := testutil.ToFloat64(sentTotal.WithLabelValues("email"))
+	cancelled := testutil.ToFloat64(cancelledTotal.WithLabelValues("email"))
+	retried := testutil.ToFloat64(retriedTotal.WithLabelValues("telegram"))
+	failed := testutil.ToFloat64(failedTotal.WithLabelValues("telegram"))
+
+	sendAt := time.Now().Add(time.Hour)
+	if _, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: sendAt}); err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	d.handleDelivery(<-broker.deliveries)
+	drop, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "bye", Channel: "email", SendAt: sendAt})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	if err := d.CancelNotification(drop); err != nil {
+		t.Fatalf("CancelNotification failed: %v", err)
+	}
+	<-broker.deliveries
+	if _, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "telegram", SendAt: sendAt}); err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	d.handleDelivery(<-broker.deliveries)
+	d.handleDelivery(<-broker.deliveries)
+
+	for name, delta := range map[string]float64{
+		"scheduled": testutil.ToFloat64(scheduledTotal.WithLabelValues("email")) - scheduled,
+		"sent":      testutil.ToFloat64(sentTotal.WithLabelValues("email")) - sent,
+		"cancelled": testutil.ToFloat64(cancelledTotal.WithLabelValues("email")) - cancelled,
+		"retried":   testutil.ToFloat64(retriedTotal.WithLabelValues("telegram")) - retried,
+		"failed":    testutil.ToFloat64(failedTotal.WithLabelValues("telegram")) - failed,
+	} {
+		want := 1.0
+		if name == "scheduled" {
+			want = 2
+		}
+		if delta != want {
+			t.Errorf("Expected %s to grow by %v, got %v", name, want, delta)
+		}
+	}
+}
+
+// lagSum returns the sum of the send lag observed on channel.
+func lagSum(t *testing.T, channel string) float64 {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(sendLag)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "channel" && label.GetValue() == channel {
+					return m.GetHistogram().GetSampleSum()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestSendLagIsMeasuredFromOriginalSendAt(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	d.senders.Register("lagged", &flakySender{failed: map[string]bool{}})
+	base := time.Now().Truncate(time.Second)
+	sendAt := base.Add(time.Hour)
+	d.now = func() time.Time { return base }
+
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "lagged", SendAt: sendAt})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	before := lagSum(t, "lagged")
+
+	// The first attempt fails and the retry moves send_at into the future.
+	d.now = func() time.Time { return sendAt }
+	d.handleDelivery(<-broker.deliveries)
+	n, _ := d.store.Get(context.Background(), id)
+	if !n.SendAt.After(sendAt) || !n.OriginalSendAt.Equal(sendAt) {
+		t.Fatalf("Expected a later send_at and the original kept, got %v and %v", n.SendAt, n.OriginalSendAt)
+	}
+
+	d.now = func() time.Time { return sendAt.Add(10 * time.Minute) }
+	d.handleDelivery(<-broker.deliveries)
+	if lag := lagSum(t, "lagged") - before; lag != 600 {
+		t.Errorf("Expected a lag of 600s from the original send_at, got %v", lag)
+	}
+}
+
+// laneDepthBroker reports fixed lane depths.
+type laneDepthBroker struct {
+	*fakeBroker
+	depths map[string]int
+}
+
+func (b *laneDepthBroker) LaneDepth(ctx context.Context, lane string) (int, error) {
+	return b.depths[lane], nil
+}
+
+func TestQueueDepthCollector(t *testing.T) {
+	client := newTestRedis(t)
+	s := NewRedisScheduler(client, func(body []byte) error { return nil })
+	broker := &laneDepthBroker{fakeBroker: newFakeBroker(), depths: map[string]int{PriorityHigh: 1, PriorityLow: 4}}
+	d := &DelayedNotifier{scheduler: s, broker: broker}
+	for _, id := range []string{"a", "b"} {
+		if err := s.Schedule(context.Background(), &Notification{ID: id, SendAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("Schedule failed: %v", err)
+		}
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newQueueDepthCollector(d))
+	expected := `
+# HELP notifications_lane_depth Due notifications waiting on a priority lane.
+# TYPE notifications_lane_depth gauge
+notifications_lane_depth{lane="high"} 1
+notifications_lane_depth{lane="low"} 4
+notifications_lane_depth{lane="normal"} 0
+# HELP notifications_queue_depth Notifications waiting in a queue.
+# TYPE notifications_queue_depth gauge
+notifications_queue_depth{queue="due"} 5
+notifications_queue_depth{queue="scheduled"} 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+
+	// The test notifier has no broker.
+	rec := httptest.NewRecorder()
+	d.ReadyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var resp struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusServiceUnavailable || resp.Checks["redis"] != "ok" || resp.Checks["broker"] == "ok" {
+		t.Errorf("Expected 503 with only the broker failing, got %d %+v", rec.Code, resp)
+	}
+
+	rec = httptest.NewRecorder()
+	d.HealthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Status != "degraded" {
+		t.Errorf("Expected 200 degraded, got %d %+v", rec.Code, resp)
+	}
+}
@@ -0,0 +1,157 @@
+// outbox.go - transactional outbox between the store and the scheduler
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// outboxPollInterval is how often the relay looks for entries left behind.
+	outboxPollInterval = 5 * time.Second
+	// outboxGracePeriod keeps the relay away from entries that enqueue is still
+	// scheduling itself.
+	outboxGracePeriod = 10 * time.Second
+	// outboxBatchSize is how many entries the relay handles per pass.
+	outboxBatchSize = 100
+	// claimLease is how long a claim protects a notification that is being
+	// sent. It is well above the senders' timeouts, so an older claim belongs
+	// to a worker that crashed or gave up mid-send.
+	claimLease = 5 * time.Minute
+	// overdueAfter is how long past its send_at a pending notification may
+	// wait before the sweeper schedules it again. It is well above the time
+	// a busy queue takes to drain, so a copy the scheduler still holds is
+	// rarely duplicated; duplicates are dropped by the worker's claim.
+	overdueAfter = 10 * time.Minute
+	// overdueSweepInterval is how often the sweeper looks for overdue notifications.
+	overdueSweepInterval = time.Minute
+)
+
+// OutboxEntry records that a version of a notification still has to reach
+// the scheduler. The store writes it in the same transaction as the
+// notification, so a notification is never saved without one.
+type OutboxEntry struct {
+	NotificationID string
+	Version        int
+	CreatedAt      time.Time
+}
+
+// outboxEntries returns the outbox entries of the notifications' current versions.
+func outboxEntries(notifications ...*Notification) []OutboxEntry {
+	entries := make([]OutboxEntry, len(notifications))
+	for i, n := range notifications {
+		entries[i] = OutboxEntry{NotificationID: n.ID, Version: n.Version}
+	}
+	return entries
+}
+
+// markScheduled marks the outbox entries of notifications that reached the scheduler.
+func (d *DelayedNotifier) markScheduled(ctx context.Context, notifications ...*Notification) {
+	d.markDone(ctx, outboxEntries(notifications...))
+}
+
+// relayOutbox schedules outbox entries that enqueue could not schedule, for
+// example because RabbitMQ was down or the process crashed in between, until
+// ctx is cancelled. An entry is only marked done after the scheduler accepted
+// it, so every notification is scheduled at least once; duplicates are
+// dropped by the worker's claim.
+func (d *DelayedNotifier) relayOutbox(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	var lastSweep time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d.releaseStaleClaims(ctx)
+		if now := d.now(); now.Sub(lastSweep) >= overdueSweepInterval {
+			lastSweep = now
+			if _, err := d.sweepOverdue(ctx); err != nil {
+				log.Printf("error sweeping overdue notifications: %v", err)
+			}
+		}
+		for {
+			n, err := d.relayOutboxOnce(ctx)
+			if err != nil {
+				log.Printf("error relaying outbox: %v", err)
+			}
+			if err != nil || n < outboxBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// relayOutboxOnce handles one batch of outbox entries and returns how many it found.
+func (d *DelayedNotifier) relayOutboxOnce(ctx context.Context) (int, error) {
+	entries, err := d.store.ListOutbox(ctx, d.now().Add(-outboxGracePeriod), outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var done []OutboxEntry
+	for _, e := range entries {
+		n, err := d.store.Get(ctx, e.NotificationID)
+		if err != nil {
+			log.Printf("error loading notification %s from the outbox: %v", e.NotificationID, err)
+			continue
+		}
+		// Cancelled, sent and edited notifications need nothing more from this entry.
+		if n.Status == "pending" && n.Version == e.Version {
+			if err := d.scheduler.Schedule(ctx, n); err != nil {
+				// Keep the order: later entries wait for the next pass.
+				d.markDone(ctx, done)
+				return len(entries), err
+			}
+		}
+		done = append(done, e)
+	}
+	d.markDone(ctx, done)
+	return len(entries), nil
+}
+
+// releaseStaleClaims hands notifications whose claim outlived claimLease back
+// to the outbox. Their worker crashed, missed the shutdown deadline or lost
+// the broker mid-send, and the broker's redelivery was dropped by the claim.
+// The release bumps the version, so a late copy of the old version is dropped too.
+func (d *DelayedNotifier) releaseStaleClaims(ctx context.Context) {
+	released, err := d.store.ReleaseStaleClaims(ctx, d.now().Add(-claimLease))
+	if err != nil {
+		log.Printf("error releasing stale claims: %v", err)
+		return
+	}
+	for _, n := range released {
+		log.Printf("released notification %s: claim by %q expired", n.ID, n.ClaimedBy)
+		d.recordStatus(ctx, n, fmt.Sprintf("claim by %q expired, queued again", n.ClaimedBy))
+	}
+}
+
+// sweepOverdue schedules pending notifications again whose send_at passed
+// more than overdueAfter ago and returns how many it found. Their outbox
+// entry is done, but the scheduler lost them: Redis restarted without its
+// data, or a message was dropped on the way. It schedules the oldest
+// outboxBatchSize per pass.
+func (d *DelayedNotifier) sweepOverdue(ctx context.Context) (int, error) {
+	overdue, err := d.store.List(ctx, NotificationFilter{Status: "pending", To: d.now().Add(-overdueAfter), Limit: outboxBatchSize})
+	if err != nil {
+		return 0, err
+	}
+	for _, n := range overdue {
+		log.Printf("notification %s is overdue since %s, scheduling it again", n.ID, n.SendAt.Format(time.RFC3339))
+		if err := d.scheduler.Schedule(ctx, n); err != nil {
+			return len(overdue), err
+		}
+	}
+	return len(overdue), nil
+}
+
+// markDone marks outbox entries done, logging failures; the entries are then relayed again.
+func (d *DelayedNotifier) markDone(ctx context.Context, entries []OutboxEntry) {
+	if err := d.store.MarkOutboxDone(ctx, entries); err != nil {
+		log.Printf("error updating outbox: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// unavailableScheduler fails every Schedule call while down is set.
+type unavailableScheduler struct {
+	*fakeBroker
+	down bool
+}
+
+func (s *unavailableScheduler) Schedule(ctx context.Context, notification *Notification) error {
+	if s.down {
+		return errors.New("broker unavailable")
+	}
+	return s.fakeBroker.Schedule(ctx, notification)
+}
+
+func TestOutboxRelaySchedulesWhatEnqueueCouldNot(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	scheduler := &unavailableScheduler{fakeBroker: broker, down: true}
+	d.scheduler = scheduler
+
+	// The notification is accepted even though it could not be scheduled.
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	cancelled, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "bye", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	if err := d.CancelNotification(cancelled); err != nil {
+		t.Fatalf("CancelNotification failed: %v", err)
+	}
+	if len(broker.deliveries) != 0 {
+		t.Fatal("Expected nothing to be scheduled while the broker is down")
+	}
+
+	ctx := context.Background()
+	d.now = func() time.Time { return time.Now().Add(outboxGracePeriod) }
+	if _, err := d.relayOutboxOnce(ctx); err == nil {
+		t.Error("Expected the relay to report the unavailable broker")
+	}
+
+	scheduler.down = false
+	if n, err := d.relayOutboxOnce(ctx); err != nil || n != 2 {
+		t.Fatalf("Expected the relay to handle 2 entries, got %d, %v", n, err)
+	}
+	if len(broker.deliveries) != 1 {
+		t.Fatalf("Expected only the pending notification to be scheduled, got %d", len(broker.deliveries))
+	}
+	broker.drain(d)
+	if sent := sender.sentIDs(); len(sent) != 1 || sent[0] != id {
+		t.Errorf("Expected %s to be sent, got %v", id, sent)
+	}
+	if n, _ := d.relayOutboxOnce(ctx); n != 0 {
+		t.Errorf("Expected an empty outbox, got %d entries", n)
+	}
+}
+
+func TestEnqueueMarksOutboxDone(t *testing.T) {
+	d, _, _ := newTestNotifier(t)
+	if _, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	entries, err := d.store.ListOutbox(context.Background(), time.Now().Add(time.Hour), 10)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected the outbox entry to be done, got %+v, %v", entries, err)
+	}
+}
+
+func TestStaleClaimIsDeliveredAgain(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	ctx := context.Background()
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+
+	// A worker claims the notification and crashes before settling it.
+	msg := <-broker.deliveries
+	if err := d.store.Claim(ctx, id, 1, "crashed", time.Now()); err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	// The broker's redelivery finds it claimed and drops it.
+	d.handleDelivery(msg)
+	if len(sender.sentIDs()) != 0 {
+		t.Fatal("Expected the redelivery to be dropped while the claim is held")
+	}
+
+	// The claim is left alone until its lease runs out.
+	d.releaseStaleClaims(ctx)
+	if n, _ := d.store.Get(ctx, id); n.Status != "sending" {
+		t.Fatalf("Expected the fresh claim to be kept, got %s", n.Status)
+	}
+
+	d.now = func() time.Time { return time.Now().Add(claimLease + outboxGracePeriod) }
+	d.releaseStaleClaims(ctx)
+	if _, err := d.relayOutboxOnce(ctx); err != nil {
+		t.Fatalf("relayOutboxOnce failed: %v", err)
+	}
+	broker.drain(d)
+	if sent := sender.sentIDs(); len(sent) != 1 || sent[0] != id {
+		t.Errorf("Expected %s to be sent after its claim expired, got %v", id, sent)
+	}
+	if n, _ := d.store.Get(ctx, id); n.Status != "sent" || n.Version != 2 {
+		t.Errorf("Expected %s sent at version 2, got %s at %d", id, n.Status, n.Version)
+	}
+}
+
+// slowSender lets its claim go stale: while sending, the claim is released
+// as if the send had outlasted claimLease. It then fails or succeeds with err.
+type slowSender struct {
+	store NotificationStore
+	err   error
+}
+
+func (s slowSender) Send(ctx context.Context, notification *Notification) error {
+	s.store.ReleaseStaleClaims(ctx, time.Now().Add(time.Hour))
+	return s.err
+}
+
+func TestSlowWorkerDoesNotOverwriteReleasedClaim(t *testing.T) {
+	for name, sendErr := range map[string]error{"sent": nil, "retried": errors.New("unavailable"), "failed": Permanent(errors.New("no such user"))} {
+		t.Run(name, func(t *testing.T) {
+			d, broker, _ := newTestNotifier(t)
+			d.senders.Register("email", slowSender{store: d.store, err: sendErr})
+			ctx := context.Background()
+			id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+			if err != nil {
+				t.Fatalf("CreateNotification failed: %v", err)
+			}
+			d.handleDelivery(<-broker.deliveries)
+
+			// The release requeued version 2; the slow worker's outcome for
+			// version 1 must not overwrite it.
+			n, _ := d.store.Get(ctx, id)
+			if n.Status != "pending" || n.Version != 2 || n.Retries != 0 {
+				t.Errorf("Expected the released notification pending at version 2, got %s at %d with %d retries", n.Status, n.Version, n.Retries)
+			}
+			if letters, _ := d.store.ListDeadLetters(ctx); len(letters) != 0 {
+				t.Errorf("Expected no dead letters, got %+v", letters)
+			}
+			if len(broker.deliveries) != 0 {
+				t.Errorf("Expected the slow worker not to reschedule, got %d deliveries", len(broker.deliveries))
+			}
+		})
+	}
+}
+
+func TestSweepReschedulesOverdueNotifications(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	ctx := context.Background()
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	if _, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "later", Channel: "email", SendAt: time.Now().Add(2 * time.Hour)}); err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+
+	// The scheduler loses what it held, as Redis does when it restarts
+	// without its data; the outbox entries are already done.
+	for len(broker.deliveries) > 0 {
+		<-broker.deliveries
+	}
+
+	d.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if n, err := d.sweepOverdue(ctx); err != nil || n != 0 {
+		t.Fatalf("Expected nothing overdue before overdueAfter, got %d, %v", n, err)
+	}
+	d.now = func() time.Time { return time.Now().Add(time.Hour + overdueAfter) }
+	if n, err := d.sweepOverdue(ctx); err != nil || n != 1 {
+		t.Fatalf("Expected 1 overdue notification, got %d, %v", n, err)
+	}
+	broker.drain(d)
+	if sent := sender.sentIDs(); len(sent) != 1 || sent[0] != id {
+		t.Errorf("Expected %s to be sent after the sweep, got %v", id, sent)
+	}
+	if n, _ := d.sweepOverdue(ctx); n != 0 {
+		t.Errorf("Expected the sent notification not to be swept again, got %d", n)
+	}
+}
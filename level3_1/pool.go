@@ -0,0 +1,125 @@
+// pool.go - concurrent consumers of the notification queue
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// defaultPrefetch is how many unacknowledged deliveries a consumer holds by default.
+const defaultPrefetch = 10
+
+// ParseChannelConcurrency reads per-channel concurrency limits from JSON such as {"email": 5, "telegram": 2}.
+func ParseChannelConcurrency(s string) (map[string]int, error) {
+	limits := map[string]int{}
+	if s == "" {
+		return limits, nil
+	}
+	if err := json.Unmarshal([]byte(s), &limits); err != nil {
+		return nil, fmt.Errorf("invalid channel concurrency: %v", err)
+	}
+	for channel, n := range limits {
+		if n < 1 {
+			return nil, fmt.Errorf("invalid channel concurrency for %s: must be positive", channel)
+		}
+	}
+	return limits, nil
+}
+
+// newChannelSlots creates a semaphore for every limited channel.
+func newChannelSlots(limits map[string]int) map[string]chan struct{} {
+	slots := make(map[string]chan struct{}, len(limits))
+	for channel, n := range limits {
+		slots[channel] = make(chan struct{}, n)
+	}
+	return slots
+}
+
+// acquireSlot waits until a send over channel is allowed and returns the
+// function that frees the slot again.
+func (d *DelayedNotifier) acquireSlot(channel string) func() {
+	slots, ok := d.channelSlots[channel]
+	if !ok {
+		return func() {}
+	}
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+// startWorkers starts n consumers of the notification queues. Deliveries are
+// claimed in the store before sending, so any number of consumers, in this
+// process or in other notifier instances, can share the queues without sending
+// a notification twice.
+func (d *DelayedNotifier) startWorkers(broker Broker, n int) {
+	d.running.Add(n)
+	for i := 0; i < n; i++ {
+		go d.worker(broker)
+	}
+}
+
+// worker processes the queues of all lanes, consuming again whenever the
+// connection to the broker has been re-established.
+func (d *DelayedNotifier) worker(broker Broker) {
+	defer d.running.Done()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-broker.Ready():
+		}
+
+		// The consumers of every lane are stopped when consume returns, which
+		// happens as soon as the channel of one lane is closed.
+		ctx, cancel := context.WithCancel(d.ctx)
+		msgs, err := consumeLanes(ctx, broker)
+		if err != nil {
+			cancel()
+			log.Printf("error consuming queue: %v", err)
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(reconnectPolicy.BaseDelay):
+			}
+			continue
+		}
+		d.consume(msgs)
+		cancel()
+	}
+}
+
+// consumeLanes registers a consumer on every lane, in the order of lanes,
+// until ctx is done.
+func consumeLanes(ctx context.Context, broker Broker) ([]<-chan Delivery, error) {
+	msgs := make([]<-chan Delivery, 0, len(lanes))
+	for _, l := range lanes {
+		ch, err := broker.Consume(ctx, l.priority)
+		if err != nil {
+			return nil, fmt.Errorf("lane %s: %v", l.priority, err)
+		}
+		msgs = append(msgs, ch)
+	}
+	return msgs, nil
+}
+
+// consume handles deliveries from msgs, one channel per lane, until the
+// notifier is closed or a channel is closed because the connection dropped.
+// Each turn prefers the next lane of laneSchedule, so higher lanes drain
+// first while lower lanes still get their share. A delivery that has started
+// is always finished, even when the notifier is closed meanwhile.
+func (d *DelayedNotifier) consume(msgs []<-chan Delivery) {
+	schedule := laneSchedule()
+	for turn := 0; ; turn++ {
+		msg, ok := nextDelivery(msgs, schedule[turn%len(schedule)], d.ctx.Done())
+		if !ok {
+			if d.ctx.Err() == nil {
+				log.Println("delivery channel closed, waiting for the broker")
+			}
+			return
+		}
+		d.handleDelivery(msg)
+	}
+}
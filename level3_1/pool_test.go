@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencySender records the highest number of sends in progress at once.
+type concurrencySender struct {
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+	sent     int
+}
+
+func (s *concurrencySender) Send(ctx context.Context, notification *Notification) error {
+	s.mu.Lock()
+	s.inFlight++
+	s.peak = max(s.peak, s.inFlight)
+	s.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	s.mu.Lock()
+	s.inFlight--
+	s.sent++
+	s.mu.Unlock()
+	return nil
+}
+
+// waitForAcks waits until the broker has acknowledged n deliveries.
+func waitForAcks(t *testing.T, broker *fakeBroker, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.ackCount() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d acks, got %d", n, broker.ackCount())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// stopWorkers stops the workers of d and waits for them to finish.
+func stopWorkers(d *DelayedNotifier) {
+	d.cancel()
+	d.running.Wait()
+}
+
+func TestWorkerPoolAcrossInstancesSendsOnce(t *testing.T) {
+	// Two notifier instances with four consumers each share the store, Redis and queue.
+	a, broker, sender := newTestNotifier(t)
+	b := &DelayedNotifier{
+		store:     a.store,
+		scheduler: broker,
+		senders:   a.senders,
+		now:       time.Now,
+		rand:      a.rand,
+		redis:     a.redis,
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	a.startWorkers(broker, 4)
+	b.startWorkers(broker, 4)
+
+	const count = 40
+	ctx := context.Background()
+	for i := 0; i < count; i++ {
+		id, err := a.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatalf("CreateNotification failed: %v", err)
+		}
+		// Deliver every notification twice, as after a redelivery.
+		n, _ := a.store.Get(ctx, id)
+		n.Status = "pending"
+		broker.Schedule(ctx, n)
+	}
+	waitForAcks(t, broker, 2*count)
+	stopWorkers(a)
+	stopWorkers(b)
+
+	sent := sender.sentIDs()
+	seen := map[string]bool{}
+	for _, id := range sent {
+		if seen[id] {
+			t.Fatalf("Notification %s was sent twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != count {
+		t.Errorf("Expected %d notifications sent, got %d", count, len(seen))
+	}
+}
+
+func TestChannelConcurrencyLimit(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	sender := &concurrencySender{}
+	d.senders.Register("email", sender)
+	d.channelSlots = newChannelSlots(map[string]int{"email": 2})
+	d.startWorkers(broker, 8)
+	defer stopWorkers(d)
+
+	for i := 0; i < 10; i++ {
+		if _, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("CreateNotification failed: %v", err)
+		}
+	}
+	waitForAcks(t, broker, 10)
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if sender.sent != 10 || sender.peak > 2 {
+		t.Errorf("Expected 10 sends with at most 2 at once, got %d with %d at once", sender.sent, sender.peak)
+	}
+}
+
+func TestParseChannelConcurrency(t *testing.T) {
+	limits, err := ParseChannelConcurrency(`{"email": 5, "telegram": 1}`)
+	if err != nil {
+		t.Fatalf("ParseChannelConcurrency failed: %v", err)
+	}
+	if limits["email"] != 5 || limits["telegram"] != 1 {
+		t.Errorf("Unexpected limits: %v", limits)
+	}
+	if _, err := ParseChannelConcurrency(`{"email": 0}`); err == nil {
+		t.Error("Expected an error for a non-positive limit")
+	}
+}
@@ -0,0 +1,184 @@
+// preferences.go - per-user delivery preferences
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AutoChannel is the channel name that delivers through the user's preferred channels.
+const AutoChannel = "auto"
+
+// UserPreferences holds how a user wants to be notified. User IDs are only
+// unique within a tenant, so preferences belong to a tenant's user.
+type UserPreferences struct {
+	TenantID       string `json:"tenant_id,omitempty"`
+	UserID         string `json:"user_id"`
+	Email          string `json:"email,omitempty"`
+	TelegramChatID string `json:"telegram_chat_id,omitempty"`
+	// Channels lists the channels tried, in order, for notifications sent to the "auto" channel.
+	Channels []string `json:"channels,omitempty"`
+	// Locale selects template variants, e.g. "en" or "pt-BR".
+	Locale string `json:"locale,omitempty"`
+	// Timezone is the IANA zone quiet hours are read in, UTC when empty.
+	Timezone   string      `json:"timezone,omitempty"`
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+}
+
+// QuietHours is a daily window, in the user's timezone, during which nothing
+// is delivered. Start and End are "HH:MM"; a window may span midnight.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// validate checks the preferences against the registered channels.
+func (p *UserPreferences) validate(senders *SenderRegistry) error {
+	if p.UserID == "" {
+		return fmt.Errorf("user_id is required")
+	}
+	for _, channel := range p.Channels {
+		if _, ok := senders.Get(channel); !ok {
+			return fmt.Errorf("unsupported channel: %s", channel)
+		}
+	}
+	if _, err := loadLocation(p.Timezone); err != nil {
+		return err
+	}
+	if p.QuietHours != nil {
+		if _, _, err := p.QuietHours.bounds(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// address returns the user's address on a channel, or "" if the preferences do not hold one.
+func (p *UserPreferences) address(channel string) string {
+	if p == nil {
+		return ""
+	}
+	switch channel {
+	case "email":
+		return p.Email
+	case "telegram":
+		return p.TelegramChatID
+	}
+	return ""
+}
+
+// quietUntil reports whether t falls inside the user's quiet hours and, if so, when they end.
+func (p *UserPreferences) quietUntil(t time.Time) (time.Time, bool) {
+	if p == nil || p.QuietHours == nil {
+		return time.Time{}, false
+	}
+	start, end, err := p.QuietHours.bounds()
+	if err != nil || start == end {
+		return time.Time{}, false
+	}
+	loc, err := loadLocation(p.Timezone)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	endOn := func(days int) time.Time {
+		return time.Date(local.Year(), local.Month(), local.Day()+days, end/60, end%60, 0, 0, loc)
+	}
+	switch {
+	case start < end && minute >= start && minute < end:
+		return endOn(0), true
+	case start > end && minute >= start:
+		return endOn(1), true
+	case start > end && minute < end:
+		return endOn(0), true
+	}
+	return time.Time{}, false
+}
+
+// bounds returns the window as minutes after midnight.
+func (q *QuietHours) bounds() (int, int, error) {
+	start, err := time.Parse("15:04", q.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("quiet_hours.start must be HH:MM")
+	}
+	end, err := time.Parse("15:04", q.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("quiet_hours.end must be HH:MM")
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
+
+// SavePreferences creates or replaces a user's preferences.
+func (d *DelayedNotifier) SavePreferences(prefs *UserPreferences) error {
+	if err := prefs.validate(d.senders); err != nil {
+		return err
+	}
+	prefs.UpdatedAt = d.now()
+	return d.store.SavePreferences(context.Background(), prefs)
+}
+
+// userPreferences returns the preferences of the tenant's user, or nil if they have none.
+func (d *DelayedNotifier) userPreferences(ctx context.Context, tenantID, userID string) (*UserPreferences, error) {
+	prefs, err := d.store.GetPreferences(ctx, tenantID, userID)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return prefs, err
+}
+
+// PreferencesHandler handles GET and PUT /users/{id}/preferences. The user
+// belongs to the tenant named by ?tenant_id=, by default the caller's own;
+// only admin keys may name another tenant.
+func (d *DelayedNotifier) PreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/users/")
+	userID, ok := strings.CutSuffix(path, "/preferences")
+	if !ok || userID == "" || strings.Contains(userID, "/") {
+		http.Error(w, `{"error": "not found"}`, http.StatusNotFound)
+		return
+	}
+	tenantID, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, `{"error": "tenant_id names another tenant"}`, http.StatusForbidden)
+		return
+	}
+
+	var prefs *UserPreferences
+	switch r.Method {
+	case http.MethodGet:
+		p, err := d.store.GetPreferences(context.Background(), tenantID, userID)
+		if err == ErrNotFound {
+			http.Error(w, `{"error": "preferences not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+			return
+		}
+		prefs = p
+	case http.MethodPut:
+		prefs = &UserPreferences{}
+		if err := json.NewDecoder(r.Body).Decode(prefs); err != nil {
+			http.Error(w, `{"error": "invalid JSON body"}`, http.StatusBadRequest)
+			return
+		}
+		prefs.TenantID, prefs.UserID = tenantID, userID
+		if err := d.SavePreferences(prefs); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]*UserPreferences{"result": prefs})
+}
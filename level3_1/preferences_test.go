@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// targetSender remembers where each notification was addressed.
+type targetSender struct {
+	mu      sync.Mutex
+	targets []string
+}
+
+func (s *targetSender) Send(ctx context.Context, notification *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets = append(s.targets, recipient(notification))
+	return nil
+}
+
+func TestQuietUntil(t *testing.T) {
+	almaty, _ := time.LoadLocation("Asia/Almaty")
+	prefs := &UserPreferences{Timezone: "Asia/Almaty", QuietHours: &QuietHours{Start: "22:00", End: "08:00"}}
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2025, 9, day, hour, minute, 0, 0, almaty)
+	}
+	cases := []struct {
+		t     time.Time
+		until time.Time
+		quiet bool
+	}{
+		{at(20, 21, 59), time.Time{}, false},
+		{at(20, 22, 0), at(21, 8, 0), true},
+		{at(21, 3, 30), at(21, 8, 0), true},
+		{at(21, 8, 0), time.Time{}, false},
+	}
+	for _, c := range cases {
+		until, quiet := prefs.quietUntil(c.t.UTC())
+		if quiet != c.quiet || !until.Equal(c.until) {
+			t.Errorf("quietUntil(%v): expected %v %v, got %v %v", c.t, c.until, c.quiet, until, quiet)
+		}
+	}
+
+	daytime := &UserPreferences{QuietHours: &QuietHours{Start: "12:00", End: "13:00"}}
+	if until, quiet := daytime.quietUntil(time.Date(2025, 9, 20, 12, 30, 0, 0, time.UTC)); !quiet || until.Hour() != 13 {
+		t.Errorf("Expected a UTC lunch window to end at 13:00, got %v %v", until, quiet)
+	}
+	var none *UserPreferences
+	if _, quiet := none.quietUntil(time.Now()); quiet {
+		t.Error("Expected no quiet hours without preferences")
+	}
+}
+
+func TestQuietHoursDeferDelivery(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	clock := &fakeClock{now: time.Date(2025, 9, 20, 23, 0, 0, 0, time.UTC)}
+	d.now = clock.Now
+	err := d.SavePreferences(&UserPreferences{UserID: "alice", QuietHours: &QuietHours{Start: "22:00", End: "07:30"}})
+	if err != nil {
+		t.Fatalf("SavePreferences failed: %v", err)
+	}
+
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: clock.Now()})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	d.handleDelivery(<-broker.deliveries)
+
+	n, _ := d.store.Get(context.Background(), id)
+	if want := time.Date(2025, 9, 21, 7, 30, 0, 0, time.UTC); n.Status != "pending" || !n.SendAt.Equal(want) || n.Retries != 0 {
+		t.Errorf("Expected pending until %v without retries, got %s at %v with %d", want, n.Status, n.SendAt, n.Retries)
+	}
+	if len(sender.sentIDs()) != 0 || len(broker.deliveries) != 1 {
+		t.Fatalf("Expected no send and one redelivery, got %v and %d", sender.sentIDs(), len(broker.deliveries))
+	}
+
+	clock.now = n.SendAt
+	d.handleDelivery(<-broker.deliveries)
+	if len(sender.sentIDs()) != 1 {
+		t.Errorf("Expected the notification to be sent after quiet hours")
+	}
+}
+
+func TestAutoChannelUsesPreferenceOrder(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	email := &targetSender{}
+	d.senders.Register("email", email)
+	d.senders.Register("telegram", failingSender{err: Permanent(errors.New("chat not found"))})
+	err := d.SavePreferences(&UserPreferences{
+		UserID:         "alice",
+		Email:          "alice@example.com",
+		TelegramChatID: "42",
+		Channels:       []string{"telegram", "email"},
+	})
+	if err != nil {
+		t.Fatalf("SavePreferences failed: %v", err)
+	}
+
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: AutoChannel, SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	d.handleDelivery(<-broker.deliveries)
+
+	if n, _ := d.store.Get(context.Background(), id); n.Status != "sent" {
+		t.Errorf("Expected sent, got %s: %s", n.Status, n.LastError)
+	}
+	if len(email.targets) != 1 || email.targets[0] != "alice@example.com" {
+		t.Errorf("Expected an email to alice@example.com, got %v", email.targets)
+	}
+
+	// Without preferences there is nowhere to send an auto notification.
+	id, _ = d.CreateNotification(NotificationRequest{UserID: "bob", Message: "hi", Channel: AutoChannel, SendAt: time.Now().Add(time.Hour)})
+	d.handleDelivery(<-broker.deliveries)
+	if n, _ := d.store.Get(context.Background(), id); n.Status != "failed" {
+		t.Errorf("Expected failed, got %s", n.Status)
+	}
+
+	if err := d.SavePreferences(&UserPreferences{UserID: "carol", Channels: []string{"pigeon"}}); err == nil {
+		t.Error("Expected an error for an unknown channel")
+	}
+}
+
+func TestPreferencesArePerTenant(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	email := &targetSender{}
+	d.senders.Register("email", email)
+
+	// An admin of acme saves the preferences of acme's user 42; an admin of
+	// ops names globex explicitly.
+	put := func(r *http.Request) {
+		rec := httptest.NewRecorder()
+		d.PreferencesHandler(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	put(asTenant(httptest.NewRequest(http.MethodPut, "/users/42/preferences",
+		strings.NewReader(`{"email": "42@acme.test", "channels": ["email"]}`)), "acme"))
+	put(asAdmin(httptest.NewRequest(http.MethodPut, "/users/42/preferences?tenant_id=globex",
+		strings.NewReader(`{"email": "42@globex.test", "channels": ["email"]}`)), "ops"))
+
+	// Without an admin key, acme can only reach its own users.
+	for _, method := range []string{http.MethodGet, http.MethodPut} {
+		rec := httptest.NewRecorder()
+		d.PreferencesHandler(rec, asTenant(httptest.NewRequest(method, "/users/42/preferences?tenant_id=globex",
+			strings.NewReader(`{"email": "evil@acme.test"}`)), "acme"))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403 for another tenant's user, got %d", method, rec.Code)
+		}
+	}
+
+	for _, tenant := range []string{"acme", "globex"} {
+		req := NotificationRequest{TenantID: tenant, UserID: "42", Message: "hi", Channel: AutoChannel, SendAt: time.Now().Add(time.Hour)}
+		if _, err := d.CreateNotification(req); err != nil {
+			t.Fatalf("CreateNotification failed: %v", err)
+		}
+		d.handleDelivery(<-broker.deliveries)
+	}
+	if len(email.targets) != 2 || email.targets[0] != "42@acme.test" || email.targets[1] != "42@globex.test" {
+		t.Errorf("Expected each tenant's user 42 at their own address, got %v", email.targets)
+	}
+
+	// ops has no user 42 of its own.
+	rec := httptest.NewRecorder()
+	d.PreferencesHandler(rec, asTenant(httptest.NewRequest(http.MethodGet, "/users/42/preferences", nil), "ops"))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another tenant's user, got %d", rec.Code)
+	}
+}
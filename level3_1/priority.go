@@ -0,0 +1,129 @@
+// priority.go - priority lanes between the scheduler and the workers
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Notification priorities. Each has its own lane, so that urgent
+// notifications do not wait behind a large campaign.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// lane is the queue of one priority. When every lane has deliveries waiting,
+// workers take them in proportion to weight.
+type lane struct {
+	priority string
+	weight   int
+}
+
+// lanes lists the lanes from the highest priority to the lowest.
+var lanes = []lane{
+	{priority: PriorityHigh, weight: 6},
+	{priority: PriorityNormal, weight: 3},
+	{priority: PriorityLow, weight: 1},
+}
+
+// validatePriority checks that priority names a lane; empty means normal.
+func validatePriority(priority string) error {
+	if priority == "" {
+		return nil
+	}
+	for _, l := range lanes {
+		if l.priority == priority {
+			return nil
+		}
+	}
+	return fmt.Errorf("priority must be %s, %s or %s", PriorityHigh, PriorityNormal, PriorityLow)
+}
+
+// laneOf returns the lane of a priority.
+func laneOf(priority string) string {
+	if priority == "" {
+		return PriorityNormal
+	}
+	return priority
+}
+
+// laneOfBody returns the lane of a queued notification.
+func laneOfBody(body []byte) string {
+	var n struct {
+		Priority string `json:"priority"`
+	}
+	json.Unmarshal(body, &n)
+	return laneOf(n.Priority)
+}
+
+// laneQueue returns the name of a lane's queue. The normal lane keeps the
+// base name, so deliveries queued before lanes existed are still consumed.
+func laneQueue(base, lane string) string {
+	if lane == PriorityNormal {
+		return base
+	}
+	return base + "." + lane
+}
+
+// laneSchedule returns the order in which a worker prefers the lanes, as
+// indexes into lanes. Every lane appears weight times, spread out with
+// smooth weighted round-robin so that no lane waits for a long run of another.
+func laneSchedule() []int {
+	total := 0
+	for _, l := range lanes {
+		total += l.weight
+	}
+	current := make([]int, len(lanes))
+	schedule := make([]int, 0, total)
+	for len(schedule) < total {
+		best := 0
+		for i, l := range lanes {
+			current[i] += l.weight
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// nextDelivery returns a delivery from msgs, which holds one channel per lane.
+// It takes from the preferred lane if it has a delivery waiting, else from
+// the highest lane that has one, else it waits for the first to arrive or
+// for done. ok is false when done is closed or a lane's channel was closed.
+func nextDelivery(msgs []<-chan Delivery, preferred int, done <-chan struct{}) (msg Delivery, ok bool) {
+	select {
+	case <-done:
+		return Delivery{}, false
+	default:
+	}
+	select {
+	case msg, ok := <-msgs[preferred]:
+		return msg, ok
+	default:
+	}
+	for _, ch := range msgs {
+		select {
+		case msg, ok := <-ch:
+			return msg, ok
+		default:
+		}
+	}
+
+	cases := make([]reflect.SelectCase, 0, len(msgs)+1)
+	for _, ch := range msgs {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+	}
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)})
+	chosen, value, ok := reflect.Select(cases)
+	if chosen == len(msgs) || !ok {
+		return Delivery{}, false
+	}
+	return value.Interface().(Delivery), true
+}
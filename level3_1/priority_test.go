@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLaneSchedule(t *testing.T) {
+	schedule := laneSchedule()
+	if len(schedule) != 10 || schedule[0] != 0 {
+		t.Fatalf("Expected 10 turns starting with the high lane, got %v", schedule)
+	}
+	counts := make([]int, len(lanes))
+	run := 0
+	for i, lane := range schedule {
+		counts[lane]++
+		if i > 0 && lane == schedule[i-1] {
+			run++
+		} else {
+			run = 1
+		}
+		if run > 2 {
+			t.Errorf("Expected the lanes to interleave, got %v", schedule)
+		}
+	}
+	for i, l := range lanes {
+		if counts[i] != l.weight {
+			t.Errorf("Expected %d turns for %s, got %d", l.weight, l.priority, counts[i])
+		}
+	}
+}
+
+func TestNextDeliveryWeightsLanes(t *testing.T) {
+	msgs := make([]<-chan Delivery, len(lanes))
+	chans := make([]chan Delivery, len(lanes))
+	for i, l := range lanes {
+		chans[i] = make(chan Delivery, 20)
+		msgs[i] = chans[i]
+		for j := 0; j < 20; j++ {
+			chans[i] <- Delivery{Body: []byte(l.priority)}
+		}
+	}
+	done := make(chan struct{})
+
+	// With every lane busy, each gets its weight's share.
+	schedule := laneSchedule()
+	counts := map[string]int{}
+	for turn := 0; turn < 20; turn++ {
+		msg, ok := nextDelivery(msgs, schedule[turn%len(schedule)], done)
+		if !ok {
+			t.Fatal("Expected a delivery")
+		}
+		counts[string(msg.Body)]++
+	}
+	if counts[PriorityHigh] != 12 || counts[PriorityNormal] != 6 || counts[PriorityLow] != 2 {
+		t.Errorf("Expected 12/6/2 deliveries, got %v", counts)
+	}
+
+	// A turn of an empty lane goes to the highest lane with work.
+	for len(chans[2]) > 0 {
+		<-chans[2]
+	}
+	if msg, _ := nextDelivery(msgs, 2, done); string(msg.Body) != PriorityHigh {
+		t.Errorf("Expected the high lane to take the turn of the empty low lane, got %s", msg.Body)
+	}
+
+	close(done)
+	if _, ok := nextDelivery(msgs, 0, done); ok {
+		t.Error("Expected no delivery once done is closed")
+	}
+}
+
+func TestUrgentNotificationSkipsTheBacklog(t *testing.T) {
+	d, _, sender := newTestNotifier(t)
+	broker := NewMemoryBroker()
+	defer broker.Close()
+	d.broker = broker
+	d.scheduler = NewBrokerScheduler(broker)
+
+	sendAt := time.Now().Add(20 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		req := NotificationRequest{UserID: fmt.Sprintf("user%d", i), Message: "sale", Channel: "email", SendAt: sendAt, Priority: PriorityLow}
+		if _, err := d.CreateNotification(req); err != nil {
+			t.Fatalf("CreateNotification failed: %v", err)
+		}
+	}
+	urgent, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "reset your password", Channel: "email", SendAt: sendAt, Priority: PriorityHigh})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	if _, err := d.CreateNotification(NotificationRequest{UserID: "bob", Message: "hi", Channel: "email", SendAt: sendAt, Priority: "urgent"}); err == nil {
+		t.Error("Expected an unknown priority to be rejected")
+	}
+
+	// The whole backlog is due before the worker starts.
+	time.Sleep(50 * time.Millisecond)
+	d.startWorkers(broker, 1)
+	defer stopWorkers(d)
+
+	waitForStatus(t, d, urgent, "sent")
+	if sent := sender.sentIDs(); sent[0] != urgent {
+		t.Errorf("Expected %s to be sent first, got %v", urgent, sent)
+	}
+}
@@ -0,0 +1,432 @@
+// rabbit.go - RabbitMQ connection that survives broker restarts
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// reconnectPolicy spaces out attempts to reach RabbitMQ after the connection drops.
+var reconnectPolicy = RetryPolicy{BaseDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second, Jitter: 0.2}
+
+// errRabbitDown is returned while the connection to RabbitMQ is being re-established.
+var errRabbitDown = errors.New("RabbitMQ is not connected")
+
+// confirmTimeout is how long Publish waits for the broker to confirm a message.
+const confirmTimeout = 10 * time.Second
+
+// RabbitMQ keeps a connection and channel to the broker open. When either is
+// closed by the broker or the network, it dials again with backoff and reruns
+// the setup functions, which declare the queues and exchanges it relies on.
+// The channel is in confirm mode, so Publish only succeeds once the broker
+// has taken responsibility for the message.
+type RabbitMQ struct {
+	url  string
+	done chan struct{}
+
+	mu       sync.Mutex
+	setup    []func(*amqp.Channel) error
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	ready    chan struct{} // closed while connected
+	closed   bool
+
+	// publishMu serializes publishing. published counts the messages sent on
+	// publishedOn, which is the delivery tag their confirmations carry.
+	publishMu   sync.Mutex
+	publishedOn *amqp.Channel
+	published   uint64
+}
+
+// DialRabbitMQ connects to url and runs setup on the new channel. The first
+// connection must succeed; later ones are retried in the background.
+func DialRabbitMQ(url string, setup ...func(*amqp.Channel) error) (*RabbitMQ, error) {
+	r := &RabbitMQ{url: url, setup: setup, done: make(chan struct{}), ready: make(chan struct{})}
+	connClosed, chClosed, err := r.connect()
+	if err != nil {
+		return nil, err
+	}
+	go r.watch(connClosed, chClosed)
+	return r, nil
+}
+
+// connect dials the broker, opens a channel and runs the setup functions.
+func (r *RabbitMQ) connect() (chan *amqp.Error, chan *amqp.Error, error) {
+	conn, err := amqp.Dial(r.url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to open RabbitMQ channel: %v", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		conn.Close()
+		return nil, nil, errRabbitDown
+	}
+	for _, setup := range r.setup {
+		if err := setup(ch); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	r.conn, r.ch, r.confirms = conn, ch, confirms
+	close(r.ready)
+	return connClosed, chClosed, nil
+}
+
+// watch waits for the connection or channel to close and reconnects until Close is called.
+func (r *RabbitMQ) watch(connClosed, chClosed chan *amqp.Error) {
+	for {
+		var reason *amqp.Error
+		select {
+		case reason = <-connClosed:
+		case reason = <-chClosed:
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		conn := r.conn
+		r.conn, r.ch = nil, nil
+		r.ready = make(chan struct{})
+		r.mu.Unlock()
+		// A channel error leaves the connection open; start from scratch either way.
+		conn.Close()
+		log.Printf("lost RabbitMQ connection: %v", reason)
+
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-r.done:
+				return
+			case <-time.After(reconnectPolicy.Backoff(attempt, rand.Float64)):
+			}
+			var err error
+			connClosed, chClosed, err = r.connect()
+			if err == nil {
+				log.Printf("reconnected to RabbitMQ after %d attempts", attempt)
+				break
+			}
+			log.Printf("error reconnecting to RabbitMQ: %v", err)
+		}
+	}
+}
+
+// OnConnect runs setup on the current channel and again after every reconnect.
+func (r *RabbitMQ) OnConnect(setup func(*amqp.Channel) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ch == nil {
+		return errRabbitDown
+	}
+	if err := setup(r.ch); err != nil {
+		return err
+	}
+	r.setup = append(r.setup, setup)
+	return nil
+}
+
+// Ready returns a channel that is closed once RabbitMQ is connected.
+func (r *RabbitMQ) Ready() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready
+}
+
+// Channel returns the open channel, or errRabbitDown while reconnecting.
+func (r *RabbitMQ) Channel() (*amqp.Channel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ch == nil {
+		return nil, errRabbitDown
+	}
+	return r.ch, nil
+}
+
+// Publish sends a message on the current channel and waits for the broker to confirm it.
+func (r *RabbitMQ) Publish(exchange, key string, msg amqp.Publishing) error {
+	r.publishMu.Lock()
+	defer r.publishMu.Unlock()
+	r.mu.Lock()
+	ch, confirms := r.ch, r.confirms
+	r.mu.Unlock()
+	if ch == nil {
+		return errRabbitDown
+	}
+	if ch != r.publishedOn {
+		r.publishedOn, r.published = ch, 0
+	}
+	if err := ch.Publish(exchange, key, false, false, msg); err != nil {
+		return err
+	}
+	r.published++
+	tag := r.published
+
+	timeout := time.NewTimer(confirmTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case c, ok := <-confirms:
+			if !ok {
+				return fmt.Errorf("channel closed before the broker confirmed the message")
+			}
+			// Skip confirmations of messages whose Publish gave up waiting.
+			if c.DeliveryTag < tag {
+				continue
+			}
+			if !c.Ack {
+				return fmt.Errorf("broker rejected the message")
+			}
+			return nil
+		case <-timeout.C:
+			return fmt.Errorf("timed out waiting for the broker to confirm the message")
+		}
+	}
+}
+
+// Consume starts delivering messages from queue. The returned channel is
+// closed when the connection drops; call Consume again once Ready. The
+// returned function stops the consumer, after which the channel is closed too.
+func (r *RabbitMQ) Consume(queue string) (<-chan amqp.Delivery, func() error, error) {
+	ch, err := r.Channel()
+	if err != nil {
+		return nil, nil, err
+	}
+	tag := newID()
+	msgs, err := ch.Consume(
+		queue, // queue
+		tag,   // consumer
+		false, // auto-ack
+		false, // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,   // args
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msgs, func() error { return ch.Cancel(tag, false) }, nil
+}
+
+// QueueDepth returns the number of messages ready for delivery in queue.
+func (r *RabbitMQ) QueueDepth(queue string) (int, error) {
+	ch, err := r.Channel()
+	if err != nil {
+		return 0, err
+	}
+	q, err := ch.QueueInspect(queue)
+	if err != nil {
+		return 0, err
+	}
+	return q.Messages, nil
+}
+
+// Close closes the connection and stops reconnecting.
+func (r *RabbitMQ) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	conn := r.conn
+	r.conn, r.ch = nil, nil
+	r.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// AMQPBroker is the Broker backed by durable RabbitMQ queues, one per lane.
+type AMQPBroker struct {
+	rabbit *RabbitMQ
+	// queue is the queue of the normal lane; the others append their priority.
+	queue string
+	// exchange is the delayed message exchange, empty unless EnableDelays was called.
+	exchange string
+}
+
+// NewAMQPBroker connects to RabbitMQ at url and declares the queue of every
+// lane, on which every consumer holds at most prefetch unacknowledged deliveries.
+func NewAMQPBroker(url, queue string, prefetch int) (*AMQPBroker, error) {
+	var setup []func(*amqp.Channel) error
+	for _, l := range lanes {
+		setup = append(setup, declareQueue(laneQueue(queue, l.priority)))
+	}
+	rabbit, err := DialRabbitMQ(url, append(setup, setPrefetch(prefetch))...)
+	if err != nil {
+		return nil, err
+	}
+	return &AMQPBroker{rabbit: rabbit, queue: queue}, nil
+}
+
+// EnableDelays declares an x-delayed-message exchange routed to the queues,
+// and declares it again whenever RabbitMQ reconnects, so that Publish can
+// hold messages back. The rabbitmq_delayed_message_exchange plugin must be
+// enabled on the broker.
+func (b *AMQPBroker) EnableDelays() error {
+	exchange := b.queue + ".delayed"
+	err := b.rabbit.OnConnect(func(ch *amqp.Channel) error {
+		err := ch.ExchangeDeclare(
+			exchange,            // name
+			"x-delayed-message", // kind
+			true,                // durable
+			false,               // auto-deleted
+			false,               // internal
+			false,               // no-wait
+			amqp.Table{"x-delayed-type": "direct"},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare delayed exchange (is rabbitmq_delayed_message_exchange enabled?): %v", err)
+		}
+		for _, l := range lanes {
+			queue := laneQueue(b.queue, l.priority)
+			if err := ch.QueueBind(queue, queue, exchange, false, nil); err != nil {
+				return fmt.Errorf("failed to bind queue %s: %v", queue, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.exchange = exchange
+	return nil
+}
+
+// Publish sends body to the queue of lane, through the delayed exchange with
+// an x-delay header if delay is positive.
+func (b *AMQPBroker) Publish(ctx context.Context, lane string, body []byte, delay time.Duration) error {
+	if err := validatePriority(lane); err != nil {
+		return fmt.Errorf("unknown lane %q", lane)
+	}
+	queue := laneQueue(b.queue, laneOf(lane))
+	msg := amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	}
+	if delay <= 0 {
+		return b.rabbit.Publish("", queue, msg)
+	}
+	if b.exchange == "" {
+		return fmt.Errorf("delayed delivery needs the delayed message exchange")
+	}
+	msg.Headers = amqp.Table{"x-delay": delay.Milliseconds()}
+	return b.rabbit.Publish(b.exchange, queue, msg)
+}
+
+// Ready returns a channel that is closed while RabbitMQ is connected.
+func (b *AMQPBroker) Ready() <-chan struct{} {
+	return b.rabbit.Ready()
+}
+
+// Consume starts delivering messages from the queue of lane. The returned
+// channel is closed when the connection drops or ctx is done.
+func (b *AMQPBroker) Consume(ctx context.Context, lane string) (<-chan Delivery, error) {
+	msgs, cancel, err := b.rabbit.Consume(laneQueue(b.queue, lane))
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make(chan Delivery)
+	go func() {
+		defer close(deliveries)
+		for msg := range msgs {
+			select {
+			case deliveries <- Delivery{Body: msg.Body, Acknowledger: amqpAcknowledger{msg}}:
+			case <-ctx.Done():
+				// Nobody reads deliveries any more. Cancelling the consumer
+				// leaves the messages it was handed unacknowledged on a
+				// channel that may stay open, so they are given back.
+				if err := cancel(); err != nil {
+					log.Printf("error cancelling consumer of lane %s: %v", lane, err)
+				}
+				msg.Nack(false, true)
+				for msg := range msgs {
+					msg.Nack(false, true)
+				}
+				return
+			case <-b.rabbit.done:
+				// Unacknowledged, the message is redelivered once the connection closes.
+				return
+			}
+		}
+	}()
+	return deliveries, nil
+}
+
+// LaneDepth returns the number of messages ready for delivery in the queue of lane.
+func (b *AMQPBroker) LaneDepth(ctx context.Context, lane string) (int, error) {
+	return b.rabbit.QueueDepth(laneQueue(b.queue, lane))
+}
+
+// Close closes the connection to RabbitMQ.
+func (b *AMQPBroker) Close() error {
+	return b.rabbit.Close()
+}
+
+// amqpAcknowledger settles a delivery on the channel it arrived on.
+type amqpAcknowledger struct {
+	msg amqp.Delivery
+}
+
+func (a amqpAcknowledger) Ack() error {
+	return a.msg.Ack(false)
+}
+
+func (a amqpAcknowledger) Nack(requeue bool) error {
+	return a.msg.Nack(false, requeue)
+}
+
+// declareQueue returns a setup function that declares the durable queue name.
+func declareQueue(name string) func(*amqp.Channel) error {
+	return func(ch *amqp.Channel) error {
+		_, err := ch.QueueDeclare(
+			name,  // name
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			nil,   // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue: %v", err)
+		}
+		return nil
+	}
+}
+
+// setPrefetch returns a setup function that limits every consumer on the
+// channel to count unacknowledged deliveries.
+func setPrefetch(count int) func(*amqp.Channel) error {
+	return func(ch *amqp.Channel) error {
+		if err := ch.Qos(count, 0, false); err != nil {
+			return fmt.Errorf("failed to set prefetch: %v", err)
+		}
+		return nil
+	}
+}
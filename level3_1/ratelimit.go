@@ -0,0 +1,186 @@
+// ratelimit.go - token-bucket rate limits for outbound notifications
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// AnyChannel configures the limit for channels without a limit of their own.
+const AnyChannel = "*"
+
+// RateLimit allows Limit notifications per Per on average, with bursts of up to Burst.
+type RateLimit struct {
+	Limit int
+	Per   time.Duration
+	Burst int
+}
+
+// rate returns the refill rate in tokens per millisecond.
+func (l RateLimit) rate() float64 {
+	return float64(l.Limit) / float64(l.Per.Milliseconds())
+}
+
+// RateLimits configures the buckets a notification has to pass. Both maps are
+// keyed by channel, with AnyChannel as the fallback.
+type RateLimits struct {
+	// Channels limits everything sent over a channel, e.g. to respect provider quotas.
+	Channels map[string]RateLimit
+	// Users limits what each user receives over a channel.
+	Users map[string]RateLimit
+}
+
+// lookup returns the limit for channel, falling back to AnyChannel.
+func lookup(limits map[string]RateLimit, channel string) (RateLimit, bool) {
+	if l, ok := limits[channel]; ok {
+		return l, true
+	}
+	l, ok := limits[AnyChannel]
+	return l, ok
+}
+
+// ParseRateLimits reads rate limits from JSON such as
+// {"channels": {"email": {"limit": 100, "per": "1m"}}, "users": {"*": {"limit": 5, "per": "1h", "burst": 10}}}.
+func ParseRateLimits(s string) (RateLimits, error) {
+	limits := RateLimits{Channels: map[string]RateLimit{}, Users: map[string]RateLimit{}}
+	if s == "" {
+		return limits, nil
+	}
+	type rawLimit struct {
+		Limit int    `json:"limit"`
+		Per   string `json:"per"`
+		Burst int    `json:"burst"`
+	}
+	var raw struct {
+		Channels map[string]rawLimit `json:"channels"`
+		Users    map[string]rawLimit `json:"users"`
+	}
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return RateLimits{}, fmt.Errorf("invalid rate limits: %v", err)
+	}
+	convert := func(dst map[string]RateLimit, src map[string]rawLimit) error {
+		for channel, r := range src {
+			per, err := time.ParseDuration(r.Per)
+			if err != nil || per < time.Millisecond {
+				return fmt.Errorf("invalid rate limit for %s: per must be a duration of at least 1ms", channel)
+			}
+			if r.Limit < 1 {
+				return fmt.Errorf("invalid rate limit for %s: limit must be positive", channel)
+			}
+			if r.Burst < 1 {
+				r.Burst = r.Limit
+			}
+			dst[channel] = RateLimit{Limit: r.Limit, Per: per, Burst: r.Burst}
+		}
+		return nil
+	}
+	if err := convert(limits.Channels, raw.Channels); err != nil {
+		return RateLimits{}, err
+	}
+	if err := convert(limits.Users, raw.Users); err != nil {
+		return RateLimits{}, err
+	}
+	return limits, nil
+}
+
+// takeTokensScript takes one token from every bucket in KEYS, or from none of
+// them. ARGV holds the current time in milliseconds followed by a rate (tokens
+// per millisecond) and burst per key. It returns 0 on success, otherwise the
+// number of milliseconds until every bucket has a token again.
+var takeTokensScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local tokens = {}
+local wait = 0
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2 * i])
+	local burst = tonumber(ARGV[2 * i + 1])
+	local bucket = redis.call('HMGET', key, 'tokens', 'ts')
+	local t = tonumber(bucket[1]) or burst
+	local ts = tonumber(bucket[2]) or now
+	t = math.min(burst, t + math.max(0, now - ts) * rate)
+	tokens[i] = t
+	if t < 1 then
+		wait = math.max(wait, math.ceil((1 - t) / rate))
+	end
+end
+if wait > 0 then
+	return wait
+end
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2 * i])
+	local burst = tonumber(ARGV[2 * i + 1])
+	redis.call('HSET', key, 'tokens', tokens[i] - 1, 'ts', now)
+	redis.call('PEXPIRE', key, math.ceil(burst / rate) + 1000)
+end
+return 0
+`)
+
+// RateLimiter enforces RateLimits with token buckets kept in Redis, so the
+// limits hold across notifier instances.
+type RateLimiter struct {
+	redis  *redis.Client
+	limits RateLimits
+}
+
+// NewRateLimiter creates a RateLimiter.
+func NewRateLimiter(client *redis.Client, limits RateLimits) *RateLimiter {
+	return &RateLimiter{redis: client, limits: limits}
+}
+
+// rateLimitedError reports that the rate limits of channel hold a
+// notification back for wait.
+type rateLimitedError struct {
+	channel string
+	wait    time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited on %s, delayed by %s", e.channel, e.wait)
+}
+
+// reserveRate takes a token for sending the notification over channel and
+// returns zero, or how long the notification has to wait. It is better to
+// send than to hold everything back while Redis is unavailable, so errors
+// let the notification through.
+func (d *DelayedNotifier) reserveRate(ctx context.Context, channel string, notification *Notification) time.Duration {
+	if d.limiter == nil {
+		return 0
+	}
+	wait, err := d.limiter.Reserve(ctx, channel, notification.TenantID, notification.UserID, d.now())
+	if err != nil {
+		log.Printf("error checking rate limit of notification %s: %v", notification.ID, err)
+		return 0
+	}
+	return wait
+}
+
+// Reserve takes a token for sending to the tenant's userID over channel at now.
+// It returns zero when the notification may go out, otherwise how long to wait
+// before trying again.
+func (l *RateLimiter) Reserve(ctx context.Context, channel, tenantID, userID string, now time.Time) (time.Duration, error) {
+	var keys []string
+	args := []any{now.UnixMilli()}
+	if limit, ok := lookup(l.limits.Channels, channel); ok {
+		keys = append(keys, "notifications:ratelimit:channel:"+channel)
+		args = append(args, limit.rate(), limit.Burst)
+	}
+	if limit, ok := lookup(l.limits.Users, channel); ok {
+		keys = append(keys, "notifications:ratelimit:user:"+channel+":"+tenantID+":"+userID)
+		args = append(args, limit.rate(), limit.Burst)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	wait, err := takeTokensScript.Run(ctx, l.redis, keys, args...).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("rate limiter: %v", err)
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
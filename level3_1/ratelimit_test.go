@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	limiter := NewRateLimiter(newTestRedis(t), RateLimits{
+		Channels: map[string]RateLimit{"sms": {Limit: 1, Per: time.Minute, Burst: 1}},
+		Users:    map[string]RateLimit{AnyChannel: {Limit: 2, Per: time.Minute, Burst: 2}},
+	})
+	ctx := context.Background()
+	t0 := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+	reserve := func(channel, user string, at time.Time) time.Duration {
+		wait, err := limiter.Reserve(ctx, channel, "acme", user, at)
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+		return wait
+	}
+
+	// Per-user bucket: a burst of two, then one token every 30 seconds.
+	for i, want := range []time.Duration{0, 0, 30 * time.Second} {
+		if got := reserve("email", "alice", t0); got != want {
+			t.Errorf("email #%d: expected wait %v, got %v", i+1, want, got)
+		}
+	}
+	if got := reserve("email", "bob", t0); got != 0 {
+		t.Errorf("Expected bob to have his own bucket, got wait %v", got)
+	}
+	if got, _ := limiter.Reserve(ctx, "email", "globex", "alice", t0); got != 0 {
+		t.Errorf("Expected alice of another tenant to have her own bucket, got wait %v", got)
+	}
+	if got := reserve("email", "alice", t0.Add(30*time.Second)); got != 0 {
+		t.Errorf("Expected a refilled token after 30s, got wait %v", got)
+	}
+
+	// The channel bucket applies on top; a denied request takes no tokens at all.
+	if got := reserve("sms", "carol", t0); got != 0 {
+		t.Errorf("Expected the first sms to pass, got wait %v", got)
+	}
+	if got := reserve("sms", "dave", t0); got != time.Minute {
+		t.Errorf("Expected a one minute wait for the sms channel, got %v", got)
+	}
+	if got := reserve("sms", "dave", t0.Add(time.Minute)); got != 0 {
+		t.Errorf("Expected dave to pass once the channel refilled, got %v", got)
+	}
+	if got := reserve("sms", "dave", t0.Add(2*time.Minute)); got != 0 {
+		t.Errorf("Expected dave's user bucket to be untouched by the denied attempt, got %v", got)
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits(`{"channels": {"email": {"limit": 100, "per": "1m"}}, "users": {"*": {"limit": 5, "per": "1h", "burst": 10}}}`)
+	if err != nil {
+		t.Fatalf("ParseRateLimits failed: %v", err)
+	}
+	if l := limits.Channels["email"]; l.Limit != 100 || l.Per != time.Minute || l.Burst != 100 {
+		t.Errorf("Unexpected channel limit %+v", l)
+	}
+	if l, ok := lookup(limits.Users, "telegram"); !ok || l.Burst != 10 {
+		t.Errorf("Expected the wildcard user limit, got %+v", l)
+	}
+	if _, err := ParseRateLimits(`{"users": {"*": {"limit": 0, "per": "1m"}}}`); err == nil {
+		t.Error("Expected an error for a zero limit")
+	}
+}
+
+func TestWorkerDelaysRateLimitedNotifications(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	clock := &fakeClock{now: time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)}
+	d.now = clock.Now
+	d.limiter = NewRateLimiter(d.redis, RateLimits{
+		Users: map[string]RateLimit{"email": {Limit: 1, Per: time.Minute, Burst: 1}},
+	})
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: clock.Now()})
+		if err != nil {
+			t.Fatalf("CreateNotification failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	d.handleDelivery(<-broker.deliveries)
+	d.handleDelivery(<-broker.deliveries)
+
+	if sent := sender.sentIDs(); len(sent) != 1 || sent[0] != ids[0] {
+		t.Fatalf("Expected only the first notification to be sent, got %v", sent)
+	}
+	n, err := d.GetNotification(ids[1])
+	if err != nil {
+		t.Fatalf("GetNotification failed: %v", err)
+	}
+	if n.Status != "pending" || !n.SendAt.Equal(clock.Now().Add(time.Minute)) || n.Retries != 0 {
+		t.Errorf("Expected a delay of one minute without retries, got %s at %v with %d", n.Status, n.SendAt, n.Retries)
+	}
+	var statuses []string
+	for _, c := range n.History {
+		statuses = append(statuses, c.Status)
+	}
+	last := n.History[len(n.History)-1]
+	if strings.Join(statuses, " ") != "pending sending pending" || !strings.Contains(last.Reason, "rate limited") {
+		t.Errorf("Expected the rate limit to show in the history, got %+v", n.History)
+	}
+
+	clock.Advance(time.Minute)
+	d.handleDelivery(<-broker.deliveries)
+	if len(sender.sentIDs()) != 2 {
+		t.Errorf("Expected the delayed notification to be sent a minute later")
+	}
+}
+
+func TestAutoChannelIsRateLimitedPerResolvedChannel(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	clock := &fakeClock{now: time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)}
+	d.now = clock.Now
+	telegram := &targetSender{}
+	d.senders.Register("telegram", telegram)
+	d.limiter = NewRateLimiter(d.redis, RateLimits{
+		Channels: map[string]RateLimit{"telegram": {Limit: 1, Per: time.Minute, Burst: 1}},
+	})
+	if err := d.SavePreferences(&UserPreferences{UserID: "alice", TelegramChatID: "42", Channels: []string{"telegram", "email"}}); err != nil {
+		t.Fatalf("SavePreferences failed: %v", err)
+	}
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: AutoChannel, SendAt: clock.Now()})
+		if err != nil {
+			t.Fatalf("CreateNotification failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	d.handleDelivery(<-broker.deliveries)
+	d.handleDelivery(<-broker.deliveries)
+
+	// The telegram limit applies to auto notifications that resolve to telegram,
+	// and the second waits for telegram rather than falling through to email.
+	if len(telegram.targets) != 1 {
+		t.Fatalf("Expected one telegram message, got %v", telegram.targets)
+	}
+	n, _ := d.store.Get(context.Background(), ids[1])
+	if n.Status != "pending" || !n.SendAt.Equal(clock.Now().Add(time.Minute)) || n.LastAttemptAt != nil {
+		t.Errorf("Expected the second to wait a minute without an attempt, got %s at %v (%v)", n.Status, n.SendAt, n.LastAttemptAt)
+	}
+	if attempts, _ := d.store.ListAttempts(context.Background(), ids[1]); len(attempts) != 0 {
+		t.Errorf("Expected no delivery attempts while rate limited, got %+v", attempts)
+	}
+
+	clock.Advance(time.Minute)
+	d.handleDelivery(<-broker.deliveries)
+	if len(telegram.targets) != 2 {
+		t.Errorf("Expected the delayed notification to go out over telegram a minute later, got %v", telegram.targets)
+	}
+}
@@ -0,0 +1,220 @@
+// recurrence.go - recurring notifications driven by cron expressions
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones must resolve even on hosts without zoneinfo
+
+	"github.com/robfig/cron/v3"
+)
+
+// Series is a recurring notification. Each occurrence is an ordinary
+// Notification with SeriesID set; the next occurrence is created once the
+// previous one is sent, fails or is cancelled.
+type Series struct {
+	ID           string         `json:"id"`
+	TenantID     string         `json:"tenant_id,omitempty"`
+	UserID       string         `json:"user_id"`
+	Message      string         `json:"message"`
+	TemplateID   string         `json:"template_id,omitempty"`
+	TemplateData map[string]any `json:"data,omitempty"`
+	Channel      string         `json:"channel"`
+	Target       string         `json:"target,omitempty"`
+	Priority     string         `json:"priority"`
+	Schedule     string         `json:"schedule"` // standard 5-field cron expression or descriptor such as @monthly
+	Timezone     string         `json:"timezone,omitempty"`
+	Active       bool           `json:"active"`
+	CreatedAt    time.Time      `json:"created_at"`
+}
+
+// loadLocation resolves an IANA timezone name, defaulting to UTC when empty.
+func loadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %s", timezone)
+	}
+	return loc, nil
+}
+
+// parseSchedule parses a cron expression evaluated in the given IANA timezone (UTC when empty).
+func parseSchedule(expr, timezone string) (cron.Schedule, *time.Location, error) {
+	loc, err := loadLocation(timezone)
+	if err != nil {
+		return nil, nil, err
+	}
+	sched, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid schedule: %v", err)
+	}
+	return sched, loc, nil
+}
+
+// nextOccurrence returns the first time the schedule fires after `after`.
+func nextOccurrence(sched cron.Schedule, loc *time.Location, after time.Time) (time.Time, error) {
+	next := sched.Next(after.In(loc))
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("schedule has no future occurrences")
+	}
+	return next, nil
+}
+
+// CreateSeries starts a recurring notification from req.Schedule and schedules
+// its first occurrence. It returns the series ID and the ID of the first occurrence.
+func (d *DelayedNotifier) CreateSeries(req NotificationRequest) (string, string, error) {
+	sched, loc, err := parseSchedule(req.Schedule, req.Timezone)
+	if err != nil {
+		return "", "", invalidRequest(err)
+	}
+	if err := d.validateRequest(req); err != nil {
+		return "", "", err
+	}
+	first, err := nextOccurrence(sched, loc, d.now())
+	if err != nil {
+		return "", "", invalidRequest(err)
+	}
+
+	series := &Series{
+		ID:           newID(),
+		TenantID:     req.TenantID,
+		UserID:       req.UserID,
+		Message:      req.Message,
+		TemplateID:   req.TemplateID,
+		TemplateData: req.TemplateData,
+		Channel:      req.Channel,
+		Target:       req.Target,
+		Priority:     laneOf(req.Priority),
+		Schedule:     req.Schedule,
+		Timezone:     req.Timezone,
+		Active:       true,
+		CreatedAt:    d.now(),
+	}
+	ctx := context.Background()
+	// The series counts against the quota once; later occurrences are free.
+	reserved := d.reserveQuota(ctx, req.TenantID, 1)
+	if reserved.granted == 0 {
+		return "", "", errQuotaExceeded
+	}
+	if err := d.store.CreateSeries(ctx, series); err != nil {
+		d.releaseQuota(ctx, reserved, 1)
+		return "", "", err
+	}
+	occurrence := d.occurrence(series, first)
+	if err := d.enqueue(ctx, occurrence); err != nil {
+		d.releaseQuota(ctx, reserved, 1)
+		return "", "", err
+	}
+	return series.ID, occurrence.ID, nil
+}
+
+// occurrence builds the notification for one run of a series. The ID is
+// derived from the run time so that an occurrence is never created twice.
+func (d *DelayedNotifier) occurrence(series *Series, at time.Time) *Notification {
+	return &Notification{
+		ID:             fmt.Sprintf("%s-%d", series.ID, at.Unix()),
+		TenantID:       series.TenantID,
+		UserID:         series.UserID,
+		Message:        series.Message,
+		TemplateID:     series.TemplateID,
+		TemplateData:   series.TemplateData,
+		Channel:        series.Channel,
+		Target:         series.Target,
+		Priority:       series.Priority,
+		SendAt:         at,
+		OriginalSendAt: at,
+		Timezone:       series.Timezone,
+		Status:         "pending",
+		SeriesID:       series.ID,
+		CreatedAt:      d.now(),
+		Version:        1,
+	}
+}
+
+// scheduleNext materialises the occurrence that follows a finished one, unless the series was stopped.
+func (d *DelayedNotifier) scheduleNext(ctx context.Context, finished *Notification) {
+	if finished.SeriesID == "" {
+		return
+	}
+	series, err := d.store.GetSeries(ctx, finished.SeriesID)
+	if err != nil {
+		log.Printf("error loading series %s: %v", finished.SeriesID, err)
+		return
+	}
+	if !series.Active {
+		return
+	}
+	sched, loc, err := parseSchedule(series.Schedule, series.Timezone)
+	if err != nil {
+		log.Printf("error parsing schedule of series %s: %v", series.ID, err)
+		return
+	}
+
+	// A cancelled occurrence is still in the future, so continue after it.
+	after := d.now()
+	if finished.SendAt.After(after) {
+		after = finished.SendAt
+	}
+	next, err := nextOccurrence(sched, loc, after)
+	if err != nil {
+		log.Printf("series %s ended: %v", series.ID, err)
+		return
+	}
+	if err := d.enqueue(ctx, d.occurrence(series, next)); err != nil {
+		log.Printf("error scheduling next occurrence of series %s: %v", series.ID, err)
+	}
+}
+
+// StopSeries stops a series of the context's tenant and cancels its pending occurrence.
+func (d *DelayedNotifier) StopSeries(ctx context.Context, id string) error {
+	series, err := d.store.GetSeries(ctx, id)
+	if err == nil && tenantFrom(ctx) != "" && series.TenantID != tenantFrom(ctx) {
+		err = ErrNotFound
+	}
+	if err == ErrNotFound {
+		return fmt.Errorf("series not found")
+	}
+	if err != nil {
+		return err
+	}
+	series.Active = false
+	if err := d.store.UpdateSeries(ctx, series); err != nil {
+		return err
+	}
+
+	pending, err := d.store.List(ctx, NotificationFilter{SeriesID: id, Status: "pending"})
+	if err != nil {
+		return err
+	}
+	for _, n := range pending {
+		if err := d.CancelNotification(n.ID); err != nil {
+			log.Printf("error cancelling occurrence %s: %v", n.ID, err)
+		}
+	}
+	return nil
+}
+
+// StopSeriesHandler handles DELETE /series/{id}.
+func (d *DelayedNotifier) StopSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/series/")
+	if err := d.StopSeries(r.Context(), id); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"result": "stopped"})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSeriesMaterialisesNextOccurrence(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	almaty, err := time.LoadLocation("Asia/Almaty")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	// Friday morning, after 09:00.
+	clock := &fakeClock{now: time.Date(2025, 9, 19, 10, 0, 0, 0, almaty)}
+	d.now = clock.Now
+
+	seriesID, first, err := d.CreateSeries(NotificationRequest{
+		UserID: "alice", Message: "standup", Channel: "email", Schedule: "0 9 * * 1-5", Timezone: "Asia/Almaty",
+	})
+	if err != nil {
+		t.Fatalf("CreateSeries failed: %v", err)
+	}
+	ctx := context.Background()
+	n, _ := d.store.Get(ctx, first)
+	monday := time.Date(2025, 9, 22, 9, 0, 0, 0, almaty)
+	if !n.SendAt.Equal(monday) || n.SeriesID != seriesID {
+		t.Fatalf("Expected first occurrence on %v, got %v", monday, n.SendAt)
+	}
+
+	// Sending Monday's occurrence schedules Tuesday's.
+	clock.now = monday
+	d.handleDelivery(<-broker.deliveries)
+	if sent := sender.sentIDs(); len(sent) != 1 || sent[0] != first {
+		t.Fatalf("Expected %s to be sent, got %v", first, sent)
+	}
+	pending, _ := d.store.List(ctx, NotificationFilter{SeriesID: seriesID, Status: "pending"})
+	if len(pending) != 1 || !pending[0].SendAt.Equal(monday.AddDate(0, 0, 1)) {
+		t.Fatalf("Expected Tuesday's occurrence to be pending, got %+v", pending)
+	}
+
+	// Cancelling a single occurrence skips it.
+	if err := d.CancelNotification(pending[0].ID); err != nil {
+		t.Fatalf("CancelNotification failed: %v", err)
+	}
+	pending, _ = d.store.List(ctx, NotificationFilter{SeriesID: seriesID, Status: "pending"})
+	if len(pending) != 1 || !pending[0].SendAt.Equal(monday.AddDate(0, 0, 2)) {
+		t.Fatalf("Expected Wednesday's occurrence to be pending, got %+v", pending)
+	}
+
+	// Stopping the series cancels what is pending and creates nothing new.
+	if err := d.StopSeries(context.Background(), seriesID); err != nil {
+		t.Fatalf("StopSeries failed: %v", err)
+	}
+	pending, _ = d.store.List(ctx, NotificationFilter{SeriesID: seriesID, Status: "pending"})
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending occurrences, got %+v", pending)
+	}
+	broker.drain(d)
+	if sent := sender.sentIDs(); len(sent) != 1 {
+		t.Errorf("Expected no further sends, got %v", sent)
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	sched, loc, err := parseSchedule("0 9 1 * *", "")
+	if err != nil {
+		t.Fatalf("parseSchedule failed: %v", err)
+	}
+	next, _ := nextOccurrence(sched, loc, time.Date(2025, 9, 20, 0, 0, 0, 0, time.UTC))
+	if want := time.Date(2025, 10, 1, 9, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("Expected %v, got %v", want, next)
+	}
+	if _, _, err := parseSchedule("0 9 * * 1-5", "Mars/Olympus"); err == nil {
+		t.Error("Expected an error for an unknown timezone")
+	}
+	if _, _, err := parseSchedule("every day", ""); err == nil {
+		t.Error("Expected an error for an invalid expression")
+	}
+}
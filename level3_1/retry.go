@@ -0,0 +1,132 @@
+// retry.go - retry policies for failed deliveries
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PermanentError marks a delivery error that retrying cannot fix, such as a
+// rejected recipient or a malformed request.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err so that the default retry policy gives up on it.
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err or any error it wraps is a PermanentError.
+func IsPermanent(err error) bool {
+	var p *PermanentError
+	return errors.As(err, &p)
+}
+
+// RetryPolicy decides whether and when a failed delivery is attempted again.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry; it doubles on every retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts.
+	MaxDelay time.Duration
+	// Jitter is the fraction (0 to 1) of the delay that is randomly taken off,
+	// so that retries of a burst of failures are spread out.
+	Jitter float64
+	// Retryable reports whether an error is worth retrying. When nil, every
+	// error except a PermanentError is retried.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy is used for channels without a policy of their own.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    time.Minute,
+	Jitter:      0.2,
+}
+
+// ShouldRetry reports whether another attempt is allowed after `attempts`
+// attempts, the last of which failed with err.
+func (p RetryPolicy) ShouldRetry(attempts int, err error) bool {
+	if attempts >= p.MaxAttempts {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return !IsPermanent(err)
+}
+
+// Backoff returns the delay before retry number `retry` (starting at 1).
+// random must return a value in [0, 1).
+func (p RetryPolicy) Backoff(retry int, random func() float64) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay -= time.Duration(float64(delay) * p.Jitter * random())
+	}
+	return delay
+}
+
+// retryPolicyJSON is the configuration format of a RetryPolicy.
+type retryPolicyJSON struct {
+	MaxAttempts int      `json:"max_attempts"`
+	BaseDelay   string   `json:"base_delay"`
+	MaxDelay    string   `json:"max_delay"`
+	Jitter      *float64 `json:"jitter"`
+}
+
+// ParseRetryPolicies parses per-channel policies from JSON such as
+// {"webhook": {"max_attempts": 6, "base_delay": "1s", "max_delay": "5m", "jitter": 0.3}}.
+// Omitted fields keep the DefaultRetryPolicy values.
+func ParseRetryPolicies(data string) (map[string]RetryPolicy, error) {
+	policies := make(map[string]RetryPolicy)
+	if data == "" {
+		return policies, nil
+	}
+	var raw map[string]retryPolicyJSON
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, fmt.Errorf("invalid retry policies: %v", err)
+	}
+	for channel, r := range raw {
+		p := DefaultRetryPolicy
+		if r.MaxAttempts > 0 {
+			p.MaxAttempts = r.MaxAttempts
+		}
+		if r.BaseDelay != "" {
+			d, err := time.ParseDuration(r.BaseDelay)
+			if err != nil {
+				return nil, fmt.Errorf("invalid base_delay for %s: %v", channel, err)
+			}
+			p.BaseDelay = d
+		}
+		if r.MaxDelay != "" {
+			d, err := time.ParseDuration(r.MaxDelay)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max_delay for %s: %v", channel, err)
+			}
+			p.MaxDelay = d
+		}
+		if r.Jitter != nil {
+			if *r.Jitter < 0 || *r.Jitter > 1 {
+				return nil, fmt.Errorf("invalid jitter for %s: must be between 0 and 1", channel)
+			}
+			p.Jitter = *r.Jitter
+		}
+		policies[channel] = p
+	}
+	return policies, nil
+}
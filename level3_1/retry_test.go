@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, want := range expected {
+		if got := p.Backoff(i+1, nil); got != want*time.Second {
+			t.Errorf("Backoff(%d): expected %v, got %v", i+1, want*time.Second, got)
+		}
+	}
+
+	p.Jitter = 0.5
+	if got := p.Backoff(2, func() float64 { return 0 }); got != 2*time.Second {
+		t.Errorf("Expected no reduction with random 0, got %v", got)
+	}
+	if got := p.Backoff(2, func() float64 { return 0.5 }); got != 1500*time.Millisecond {
+		t.Errorf("Expected 1.5s with random 0.5, got %v", got)
+	}
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3}
+	transient := errors.New("timeout")
+	if !p.ShouldRetry(1, transient) || !p.ShouldRetry(2, transient) {
+		t.Error("Expected transient errors to be retried before MaxAttempts")
+	}
+	if p.ShouldRetry(3, transient) {
+		t.Error("Expected no retry once MaxAttempts is reached")
+	}
+	if p.ShouldRetry(1, fmt.Errorf("webhook: %w", Permanent(errors.New("HTTP 404")))) {
+		t.Error("Expected wrapped permanent errors not to be retried")
+	}
+
+	p.Retryable = func(err error) bool { return err == transient }
+	if p.ShouldRetry(1, errors.New("other")) {
+		t.Error("Expected custom Retryable to be honoured")
+	}
+}
+
+func TestParseRetryPolicies(t *testing.T) {
+	policies, err := ParseRetryPolicies(`{"webhook": {"max_attempts": 6, "base_delay": "500ms", "jitter": 0}}`)
+	if err != nil {
+		t.Fatalf("ParseRetryPolicies failed: %v", err)
+	}
+	p := policies["webhook"]
+	if p.MaxAttempts != 6 || p.BaseDelay != 500*time.Millisecond || p.MaxDelay != DefaultRetryPolicy.MaxDelay || p.Jitter != 0 {
+		t.Errorf("Unexpected policy %+v", p)
+	}
+	if _, err := ParseRetryPolicies(`{"email": {"base_delay": "soon"}}`); err == nil {
+		t.Error("Expected an error for an invalid duration")
+	}
+}
+
+func TestWorkerRetriesOncePerFailure(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	clock := &fakeClock{now: time.Date(2025, 9, 20, 9, 0, 0, 0, time.UTC)}
+	d.now = clock.Now
+	d.rand = func() float64 { return 0.5 }
+	d.retryPolicies = map[string]RetryPolicy{
+		"email": {MaxAttempts: 3, BaseDelay: 10 * time.Second, MaxDelay: time.Minute, Jitter: 0.5},
+	}
+	d.senders.Register("email", failingSender{err: errors.New("connection refused")})
+
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: clock.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+
+	// Each failed attempt must ack its message and schedule exactly one redelivery.
+	for attempt, delay := range []time.Duration{7500 * time.Millisecond, 15 * time.Second} {
+		start := clock.Now()
+		d.handleDelivery(<-broker.deliveries)
+		if len(broker.deliveries) != 1 {
+			t.Fatalf("attempt %d: expected exactly one redelivery, got %d", attempt+1, len(broker.deliveries))
+		}
+		n, _ := d.store.Get(context.Background(), id)
+		if !n.SendAt.Equal(start.Add(delay)) {
+			t.Errorf("attempt %d: expected send_at %v, got %v", attempt+1, start.Add(delay), n.SendAt)
+		}
+		if n.Status != "pending" || n.Retries != attempt+1 || n.LastError != "connection refused" {
+			t.Errorf("attempt %d: unexpected notification %+v", attempt+1, n)
+		}
+		clock.Advance(delay)
+	}
+
+	d.handleDelivery(<-broker.deliveries)
+	if len(broker.deliveries) != 0 {
+		t.Errorf("Expected no redelivery after the last attempt, got %d", len(broker.deliveries))
+	}
+	if status, _ := d.GetNotificationStatus(id); status != "failed" {
+		t.Errorf("Expected failed, got %s", status)
+	}
+	if len(broker.acked) != 3 || len(broker.nacked) != 0 {
+		t.Errorf("Expected 3 acks and no nacks, got %v and %v", broker.acked, broker.nacked)
+	}
+}
+
+func TestWorkerDoesNotRetryPermanentErrors(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	d.senders.Register("email", failingSender{err: Permanent(errors.New("550 no such user"))})
+
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	d.handleDelivery(<-broker.deliveries)
+
+	if len(broker.deliveries) != 0 {
+		t.Errorf("Expected no redelivery, got %d", len(broker.deliveries))
+	}
+	n, _ := d.store.Get(context.Background(), id)
+	if n.Status != "failed" || n.Retries != 0 {
+		t.Errorf("Expected failed without retries, got %s with %d", n.Status, n.Retries)
+	}
+}
@@ -0,0 +1,284 @@
+// scheduler.go - releases notifications to the worker queue when they are due
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	scheduleKey   = "notifications:schedule"
+	payloadKey    = "notifications:payload"
+	processingKey = "notifications:processing"
+)
+
+// Scheduler holds notifications back until their SendAt and then hands them to the worker queue.
+type Scheduler interface {
+	// Schedule arranges for the notification to reach the worker at notification.SendAt.
+	Schedule(ctx context.Context, notification *Notification) error
+	// Run releases due notifications until ctx is cancelled.
+	Run(ctx context.Context)
+}
+
+// BatchScheduler is implemented by schedulers that can schedule many
+// notifications in fewer round trips than one Schedule call each.
+type BatchScheduler interface {
+	ScheduleBatch(ctx context.Context, notifications []*Notification) error
+}
+
+// popDueScript atomically moves due notifications from the schedule to the
+// processing set so that several notifier instances never release the same
+// entry twice. The payload stays until doneScript confirms the publish; an
+// entry whose lease in the processing set ran out, because the instance that
+// popped it died before the broker confirmed it, is put back on the schedule.
+var popDueScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[3], id)
+	redis.call('ZADD', KEYS[1], 'NX', ARGV[1], id)
+end
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+local out = {}
+for _, id in ipairs(ids) do
+	local body = redis.call('HGET', KEYS[2], id)
+	redis.call('ZREM', KEYS[1], id)
+	if body then
+		redis.call('ZADD', KEYS[3], ARGV[3], id)
+		table.insert(out, id)
+		table.insert(out, body)
+	end
+end
+return out
+`)
+
+// doneScript forgets a published entry. If the notification was scheduled
+// again in the meantime its newer payload is left alone.
+var doneScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) == ARGV[2] then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	redis.call('ZREM', KEYS[3], ARGV[1])
+end
+return 0
+`)
+
+// RedisScheduler keeps pending notifications in a Redis sorted set scored by send time.
+type RedisScheduler struct {
+	redis        *redis.Client
+	publish      func(body []byte) error
+	pollInterval time.Duration
+	batchSize    int
+	// lease is how long a popped entry may wait for its publish to be
+	// confirmed before another pass releases it again.
+	lease time.Duration
+	wake  chan struct{}
+	now   func() time.Time
+}
+
+// NewRedisScheduler creates a RedisScheduler that hands due notifications to publish.
+func NewRedisScheduler(client *redis.Client, publish func(body []byte) error) *RedisScheduler {
+	return &RedisScheduler{
+		redis:        client,
+		publish:      publish,
+		pollInterval: time.Second,
+		batchSize:    100,
+		lease:        time.Minute,
+		wake:         make(chan struct{}, 1),
+		now:          time.Now,
+	}
+}
+
+// Schedule adds the notification to the sorted set.
+func (s *RedisScheduler) Schedule(ctx context.Context, notification *Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	if err := s.add(ctx, notification.ID, body, notification.SendAt); err != nil {
+		return err
+	}
+
+	// Let Run recompute its sleep in case this is the earliest entry.
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ScheduleBatch adds all notifications to the sorted set in one pipeline.
+func (s *RedisScheduler) ScheduleBatch(ctx context.Context, notifications []*Notification) error {
+	bodies := make([][]byte, len(notifications))
+	for i, n := range notifications {
+		body, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		bodies[i] = body
+	}
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, n := range notifications {
+			queueAdd(ctx, pipe, n.ID, bodies[i], n.SendAt)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// add stores the payload and its due time.
+func (s *RedisScheduler) add(ctx context.Context, id string, body []byte, sendAt time.Time) error {
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		queueAdd(ctx, pipe, id, body, sendAt)
+		return nil
+	})
+	return err
+}
+
+// queueAdd queues the commands that store a payload and its due time.
+func queueAdd(ctx context.Context, pipe redis.Pipeliner, id string, body []byte, sendAt time.Time) {
+	pipe.HSet(ctx, payloadKey, id, body)
+	// Round up so that a notification is never released before its SendAt.
+	score := (sendAt.UnixNano() + int64(time.Millisecond) - 1) / int64(time.Millisecond)
+	pipe.ZAdd(ctx, scheduleKey, &redis.Z{Score: float64(score), Member: id})
+}
+
+// Depth returns the number of notifications waiting to become due.
+func (s *RedisScheduler) Depth(ctx context.Context) (int, error) {
+	n, err := s.redis.ZCard(ctx, scheduleKey).Result()
+	return int(n), err
+}
+
+// Run releases due notifications until ctx is cancelled. It sleeps until the
+// earliest entry is due, but never longer than pollInterval so that entries
+// added by other instances are picked up.
+func (s *RedisScheduler) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.wake:
+		}
+
+		wait, err := s.releaseDue(ctx)
+		if err != nil {
+			log.Printf("error releasing scheduled notifications: %v", err)
+			wait = s.pollInterval
+		}
+		timer.Reset(wait)
+	}
+}
+
+// popDue moves the notifications due at now to the processing set and returns
+// their IDs and payloads, alternating.
+func (s *RedisScheduler) popDue(ctx context.Context, now time.Time) ([]string, error) {
+	keys := []string{scheduleKey, payloadKey, processingKey}
+	res, err := popDueScript.Run(ctx, s.redis, keys, now.UnixMilli(), s.batchSize, now.Add(s.lease).UnixMilli()).StringSlice()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// done forgets an entry once the broker has confirmed its publish.
+func (s *RedisScheduler) done(ctx context.Context, id, body string) error {
+	return doneScript.Run(ctx, s.redis, []string{scheduleKey, payloadKey, processingKey}, id, body).Err()
+}
+
+// retry moves a popped entry back to the schedule, due at now.
+func (s *RedisScheduler) retry(ctx context.Context, id string, now time.Time) error {
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, processingKey, id)
+		pipe.ZAdd(ctx, scheduleKey, &redis.Z{Score: float64(now.UnixMilli()), Member: id})
+		return nil
+	})
+	return err
+}
+
+// releaseDue publishes every due notification and returns how long to wait before the next check.
+func (s *RedisScheduler) releaseDue(ctx context.Context) (time.Duration, error) {
+	now := s.now()
+	res, err := s.popDue(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i+1 < len(res); i += 2 {
+		id, body := res[i], res[i+1]
+		if err := s.publish([]byte(body)); err != nil {
+			log.Printf("error publishing notification %s: %v", id, err)
+			// Put this and the remaining entries back so they are retried on the next pass.
+			for j := i; j+1 < len(res); j += 2 {
+				if err := s.retry(ctx, res[j], now); err != nil {
+					log.Printf("error rescheduling notification %s: %v", res[j], err)
+				}
+			}
+			return s.pollInterval, nil
+		}
+		// An entry that is not forgotten is published again once its lease
+		// runs out; the worker drops the second copy.
+		if err := s.done(ctx, id, body); err != nil {
+			log.Printf("error removing published notification %s: %v", id, err)
+		}
+	}
+	if len(res)/2 == s.batchSize {
+		return 0, nil
+	}
+
+	next, err := s.redis.ZRangeWithScores(ctx, scheduleKey, 0, 0).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(next) == 0 {
+		return s.pollInterval, nil
+	}
+	wait := time.Until(time.UnixMilli(int64(next[0].Score)))
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > s.pollInterval {
+		wait = s.pollInterval
+	}
+	return wait, nil
+}
+
+// BrokerScheduler leaves the delay to the broker, which must be able to hold
+// messages back: RabbitMQ with the rabbitmq_delayed_message_exchange plugin,
+// or the in-memory broker.
+type BrokerScheduler struct {
+	broker Broker
+}
+
+// NewBrokerScheduler creates a BrokerScheduler that publishes to broker.
+func NewBrokerScheduler(broker Broker) *BrokerScheduler {
+	return &BrokerScheduler{broker: broker}
+}
+
+// Schedule publishes the notification, delayed until its SendAt.
+func (s *BrokerScheduler) Schedule(ctx context.Context, notification *Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	delay := time.Until(notification.SendAt)
+	if delay < 0 {
+		delay = 0
+	}
+	return s.broker.Publish(ctx, laneOf(notification.Priority), body, delay)
+}
+
+// Run does nothing; the broker releases the messages itself.
+func (s *BrokerScheduler) Run(ctx context.Context) {}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestRedis starts an in-process Redis server and returns a client for it.
+func newTestRedis(t *testing.T) *redis.Client {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRedisSchedulerRoundsScoresUp(t *testing.T) {
+	client := newTestRedis(t)
+	s := NewRedisScheduler(client, func(body []byte) error { return nil })
+
+	// A send_at just past a millisecond boundary must not be released at that boundary.
+	ctx := context.Background()
+	sendAt := time.UnixMilli(1_700_000_000_000).Add(time.Nanosecond)
+	if err := s.Schedule(ctx, &Notification{ID: "n1", SendAt: sendAt}); err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+	score, err := client.ZScore(ctx, scheduleKey, "n1").Result()
+	if err != nil {
+		t.Fatalf("ZScore failed: %v", err)
+	}
+	if want := float64(1_700_000_000_001); score != want {
+		t.Errorf("Expected score %.0f, got %.0f", want, score)
+	}
+}
+
+func TestRedisSchedulerReleasesWhenDue(t *testing.T) {
+	client := newTestRedis(t)
+
+	var mu sync.Mutex
+	var released []string
+	var releasedAt []time.Time
+	s := NewRedisScheduler(client, func(body []byte) error {
+		var n Notification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Errorf("bad payload: %v", err)
+		}
+		mu.Lock()
+		released = append(released, n.ID)
+		releasedAt = append(releasedAt, time.Now())
+		mu.Unlock()
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	now := time.Now()
+	later := &Notification{ID: "later", SendAt: now.Add(300 * time.Millisecond)}
+	sooner := &Notification{ID: "sooner", SendAt: now.Add(100 * time.Millisecond)}
+	for _, n := range []*Notification{later, sooner} {
+		if err := s.Schedule(ctx, n); err != nil {
+			t.Fatalf("Schedule failed: %v", err)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if len(released) != 0 {
+		t.Errorf("Expected nothing released yet, got %v", released)
+	}
+	mu.Unlock()
+
+	time.Sleep(500 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(released) != 2 || released[0] != "sooner" || released[1] != "later" {
+		t.Fatalf("Expected [sooner later], got %v", released)
+	}
+	if releasedAt[0].Before(sooner.SendAt) || releasedAt[1].Before(later.SendAt) {
+		t.Errorf("Released before send_at: %v", releasedAt)
+	}
+	if n, _ := client.ZCard(ctx, scheduleKey).Result(); n != 0 {
+		t.Errorf("Expected empty schedule, got %d entries", n)
+	}
+}
+
+func TestRedisSchedulerScheduleBatch(t *testing.T) {
+	client := newTestRedis(t)
+	var released []string
+	s := NewRedisScheduler(client, func(body []byte) error {
+		var n Notification
+		json.Unmarshal(body, &n)
+		released = append(released, n.ID)
+		return nil
+	})
+
+	ctx := context.Background()
+	now := time.Now()
+	batch := []*Notification{
+		{ID: "b", SendAt: now.Add(-time.Second)},
+		{ID: "a", SendAt: now.Add(-2 * time.Second)},
+		{ID: "c", SendAt: now.Add(time.Hour)},
+	}
+	if err := s.ScheduleBatch(ctx, batch); err != nil {
+		t.Fatalf("ScheduleBatch failed: %v", err)
+	}
+	if n, _ := client.ZCard(ctx, scheduleKey).Result(); n != 3 {
+		t.Fatalf("Expected 3 scheduled entries, got %d", n)
+	}
+	if _, err := s.releaseDue(ctx); err != nil {
+		t.Fatalf("releaseDue failed: %v", err)
+	}
+	if len(released) != 2 || released[0] != "a" || released[1] != "b" {
+		t.Errorf("Expected [a b] to be released, got %v", released)
+	}
+}
+
+func TestRedisSchedulerReleasesEntriesOfACrashedInstance(t *testing.T) {
+	client := newTestRedis(t)
+	var released []string
+	s := NewRedisScheduler(client, func(body []byte) error {
+		var n Notification
+		json.Unmarshal(body, &n)
+		released = append(released, n.ID)
+		return nil
+	})
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	if err := s.Schedule(ctx, &Notification{ID: "n1", SendAt: now.Add(-time.Second)}); err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+	// Another instance pops the entry and dies before publishing it.
+	if res, err := s.popDue(ctx, now); err != nil || len(res) != 2 {
+		t.Fatalf("Expected n1 to be popped, got %v (%v)", res, err)
+	}
+	if _, err := s.releaseDue(ctx); err != nil {
+		t.Fatalf("releaseDue failed: %v", err)
+	}
+	if len(released) != 0 {
+		t.Fatalf("Expected n1 to wait for its lease, got %v", released)
+	}
+
+	// Once the lease has run out the entry is released again, and forgotten
+	// after the publish.
+	now = now.Add(s.lease + time.Second)
+	if _, err := s.releaseDue(ctx); err != nil {
+		t.Fatalf("releaseDue failed: %v", err)
+	}
+	if len(released) != 1 || released[0] != "n1" {
+		t.Errorf("Expected n1 to be released, got %v", released)
+	}
+	if n, _ := client.HLen(ctx, payloadKey).Result(); n != 0 {
+		t.Errorf("Expected the payload to be removed after the publish, got %d", n)
+	}
+	if n, _ := client.ZCard(ctx, processingKey).Result(); n != 0 {
+		t.Errorf("Expected nothing processing, got %d", n)
+	}
+}
@@ -0,0 +1,75 @@
+// sender.go - delivery channels for notifications
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Sender delivers a notification over a single channel.
+type Sender interface {
+	Send(ctx context.Context, notification *Notification) error
+}
+
+// ResponseSender is implemented by senders that can report what the provider
+// answered, such as an HTTP status or a message ID, for the delivery attempts.
+type ResponseSender interface {
+	SendWithResponse(ctx context.Context, notification *Notification) (string, error)
+}
+
+// send delivers the notification with sender and returns the provider's
+// response, which is empty unless sender is a ResponseSender.
+func send(ctx context.Context, sender Sender, notification *Notification) (string, error) {
+	if rs, ok := sender.(ResponseSender); ok {
+		return rs.SendWithResponse(ctx, notification)
+	}
+	return "", sender.Send(ctx, notification)
+}
+
+// SenderRegistry maps channel names such as "email" to their Sender.
+type SenderRegistry struct {
+	mu      sync.RWMutex
+	senders map[string]Sender
+}
+
+// NewSenderRegistry creates an empty SenderRegistry.
+func NewSenderRegistry() *SenderRegistry {
+	return &SenderRegistry{senders: make(map[string]Sender)}
+}
+
+// Register adds or replaces the sender for a channel.
+func (r *SenderRegistry) Register(channel string, sender Sender) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.senders[channel] = sender
+}
+
+// Get returns the sender for a channel.
+func (r *SenderRegistry) Get(channel string) (Sender, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sender, ok := r.senders[channel]
+	return sender, ok
+}
+
+// recipient returns the address a notification is delivered to: its target,
+// which is filled in from the user's preferences, or else the user ID.
+func recipient(notification *Notification) string {
+	if notification.Target != "" {
+		return notification.Target
+	}
+	return notification.UserID
+}
+
+// LogSender only logs notifications. It stands in for channels that are not configured.
+type LogSender struct {
+	Channel string
+}
+
+// Send logs the notification.
+func (s LogSender) Send(ctx context.Context, notification *Notification) error {
+	log.Printf("Sending %s to user %s at %s: %s", s.Channel, notification.UserID, recipient(notification), notification.Message)
+	return nil
+}
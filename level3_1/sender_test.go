@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// smtpSession is what the fake SMTP server saw during one conversation.
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// startFakeSMTP runs a minimal plain-text SMTP server that accepts one session.
+func startFakeSMTP(t *testing.T) (string, <-chan smtpSession) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		var s smtpSession
+		reply("220 localhost ESMTP fake")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch cmd {
+			case "EHLO", "HELO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				parts := strings.Fields(line)
+				decoded, _ := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+				s.auth = string(decoded)
+				reply("235 2.7.0 Authentication successful")
+			case "MAIL":
+				s.from = line[len("MAIL FROM:"):]
+				reply("250 OK")
+			case "RCPT":
+				s.to = append(s.to, line[len("RCPT TO:"):])
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var b strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					b.WriteString(l)
+				}
+				s.data = b.String()
+				reply("250 OK queued")
+			case "QUIT":
+				reply("221 Bye")
+				sessions <- s
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String(), sessions
+}
+
+// splitHostPort splits a listener address into host and numeric port.
+func splitHostPort(t *testing.T, addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("bad address %s: %v", addr, err)
+	}
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+func TestSMTPSender(t *testing.T) {
+	addr, sessions := startFakeSMTP(t)
+	host, port := splitHostPort(t, addr)
+
+	sender := NewSMTPSender(SMTPConfig{
+		Host:     host,
+		Port:     port,
+		Username: "user",
+		Password: "secret",
+		From:     "notifier@example.com",
+		TLS:      "none",
+	})
+	n := &Notification{ID: "n1", UserID: "alice@example.com", Message: "Time to stretch"}
+	if err := sender.Send(context.Background(), n); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	s := <-sessions
+	if s.auth != "\x00user\x00secret" {
+		t.Errorf("Unexpected AUTH PLAIN payload %q", s.auth)
+	}
+	if s.from != "<notifier@example.com>" {
+		t.Errorf("Unexpected MAIL FROM %q", s.from)
+	}
+	if len(s.to) != 1 || s.to[0] != "<alice@example.com>" {
+		t.Errorf("Unexpected RCPT TO %v", s.to)
+	}
+	if !strings.Contains(s.data, "To: alice@example.com\r\n") || !strings.Contains(s.data, "\r\n\r\nTime to stretch\r\n") {
+		t.Errorf("Unexpected message:\n%s", s.data)
+	}
+}
+
+func TestSMTPSenderRequiresStartTLS(t *testing.T) {
+	addr, _ := startFakeSMTP(t)
+	host, port := splitHostPort(t, addr)
+
+	sender := NewSMTPSender(SMTPConfig{Host: host, Port: port, From: "notifier@example.com"})
+	err := sender.Send(context.Background(), &Notification{UserID: "alice@example.com"})
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Expected STARTTLS error, got %v", err)
+	}
+}
+
+func TestTelegramSender(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		if gotBody["chat_id"] == "blocked" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	defer srv.Close()
+
+	sender := NewTelegramSender("123:abc", srv.URL)
+	n := &Notification{ID: "n1", UserID: "42", Message: "Standup in 5 minutes"}
+	response, err := sender.SendWithResponse(context.Background(), n)
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if response != "message_id 1" {
+		t.Errorf("Unexpected response %q", response)
+	}
+	if gotPath != "/bot123:abc/sendMessage" {
+		t.Errorf("Unexpected path %s", gotPath)
+	}
+	if gotBody["chat_id"] != "42" || gotBody["text"] != "Standup in 5 minutes" {
+		t.Errorf("Unexpected body %v", gotBody)
+	}
+
+	n.UserID = "blocked"
+	response, err = sender.SendWithResponse(context.Background(), n)
+	if err == nil || !strings.Contains(err.Error(), "bot was blocked") {
+		t.Errorf("Expected Bot API error, got %v", err)
+	}
+	if !strings.HasPrefix(response, "HTTP 403") {
+		t.Errorf("Expected the response to carry the status, got %q", response)
+	}
+}
+
+func TestWebhookSenderSignsBody(t *testing.T) {
+	secret := []byte("s3cret")
+	var verified bool
+	var payload webhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		verified = VerifyWebhook(secret, r.Header.Get(TimestampHeader), body, r.Header.Get(SignatureHeader))
+		json.Unmarshal(body, &payload)
+	}))
+	defer srv.Close()
+
+	sender := NewWebhookSender(string(secret))
+	sender.client, sender.allowPrivate = srv.Client(), true
+	n := &Notification{ID: "n1", UserID: "u1", Message: "deploy finished", Target: srv.URL}
+	if err := sender.Send(context.Background(), n); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if !verified {
+		t.Error("Signature did not verify")
+	}
+	if payload.ID != "n1" || payload.Message != "deploy finished" {
+		t.Errorf("Unexpected payload %+v", payload)
+	}
+	if VerifyWebhook([]byte("other"), "1", []byte("{}"), SignWebhook(secret, "1", []byte("{}"))) {
+		t.Error("Signature verified with the wrong secret")
+	}
+}
+
+func TestWebhookSenderRefusesInternalTargets(t *testing.T) {
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer srv.Close()
+
+	// Both a literal loopback address and a name resolving to one are refused
+	// when connecting, before anything is sent.
+	sender := NewWebhookSender("s3cret")
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	for _, target := range []string{srv.URL, "http://localhost:" + port} {
+		err := sender.Send(context.Background(), &Notification{ID: "n1", Target: target})
+		if !errors.Is(err, errPrivateTarget) || !IsPermanent(err) {
+			t.Errorf("%s: expected a permanent errPrivateTarget, got %v", target, err)
+		}
+	}
+	if hits != 0 {
+		t.Errorf("Expected no request to reach the internal server, got %d", hits)
+	}
+
+	for target, public := range map[string]bool{
+		"https://hooks.example.com/x":              true,
+		"http://93.184.216.34/hook":                true,
+		"http://127.0.0.1:8080/":                   false,
+		"http://10.1.2.3/":                         false,
+		"http://192.168.0.10/":                     false,
+		"http://169.254.169.254/latest/meta-data/": false,
+		"http://100.64.0.1/":                       false,
+		"http://0.0.0.0/":                          false,
+		"http://[::1]/":                            false,
+		"http://[fd00::1]/":                        false,
+		"http://[::ffff:127.0.0.1]/":               false,
+	} {
+		if err := sender.ValidateTarget(target); (err == nil) != public {
+			t.Errorf("ValidateTarget(%s): expected public=%v, got %v", target, public, err)
+		}
+	}
+}
+
+func TestSlackSender(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		if got["text"] == "" {
+			http.Error(w, "no_text", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	sender := NewSlackSender()
+	sender.client, sender.allowPrivate = srv.Client(), true
+	if err := sender.Send(context.Background(), &Notification{Message: "hello", Target: srv.URL}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if got["text"] != "hello" {
+		t.Errorf("Unexpected body %v", got)
+	}
+	response, err := sender.SendWithResponse(context.Background(), &Notification{Target: srv.URL})
+	if err == nil || err.Error() != "slack: HTTP 400" {
+		t.Errorf("Expected an HTTP 400 error without the body, got %v", err)
+	}
+	if response != "HTTP 400 no_text" {
+		t.Errorf("Unexpected response %q", response)
+	}
+	if err := sender.ValidateTarget("ftp://example.com"); err == nil {
+		t.Error("ValidateTarget should reject non-http URLs")
+	}
+}
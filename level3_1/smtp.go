@@ -0,0 +1,135 @@
+// smtp.go - email delivery over SMTP
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPConfig configures an SMTPSender.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// TLS is "starttls" (default), "tls" for implicit TLS (usually port 465) or "none".
+	TLS string
+	// TLSConfig overrides the TLS settings, e.g. to trust a private CA.
+	TLSConfig *tls.Config
+	// Timeout bounds a whole SMTP session. Defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+// SMTPSender sends notifications as plain-text emails. The recipient address is
+// the notification target, or the user ID when there is none.
+type SMTPSender struct {
+	cfg SMTPConfig
+}
+
+// NewSMTPSender creates an SMTPSender.
+func NewSMTPSender(cfg SMTPConfig) *SMTPSender {
+	if cfg.TLS == "" {
+		cfg.TLS = "starttls"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.TLSConfig == nil {
+		cfg.TLSConfig = &tls.Config{ServerName: cfg.Host}
+	}
+	return &SMTPSender{cfg: cfg}
+}
+
+// Send delivers the notification in a single SMTP session.
+func (s *SMTPSender) Send(ctx context.Context, notification *Notification) error {
+	to := recipient(notification)
+	if err := s.send(ctx, to, s.buildMessage(to, notification)); err != nil {
+		// 5xx replies such as an unknown mailbox will not change on retry.
+		var reply *textproto.Error
+		if errors.As(err, &reply) && reply.Code >= 500 {
+			return Permanent(fmt.Errorf("smtp: %w", err))
+		}
+		return fmt.Errorf("smtp: %w", err)
+	}
+	return nil
+}
+
+// send runs the SMTP conversation.
+func (s *SMTPSender) send(ctx context.Context, to string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if s.cfg.TLS == "tls" {
+		conn = tls.Client(conn, s.cfg.TLSConfig)
+	}
+
+	c, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.cfg.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("server does not support STARTTLS")
+		}
+		if err := c.StartTLS(s.cfg.TLSConfig); err != nil {
+			return err
+		}
+	}
+	if s.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.cfg.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildMessage formats the notification as an RFC 5322 message.
+func (s *SMTPSender) buildMessage(to string, notification *Notification) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: Notification\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprintf(&b, "\r\n%s\r\n", strings.ReplaceAll(notification.Message, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,1526 @@
+// store.go - persistent storage for notifications
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a notification does not exist in the store.
+	ErrNotFound = errors.New("notification not found")
+	// ErrStatusConflict is returned when a status update finds an unexpected current status.
+	ErrStatusConflict = errors.New("notification status changed")
+)
+
+// NotificationStore persists notifications so their state survives restarts.
+type NotificationStore interface {
+	// Create saves a new notification together with its outbox entry.
+	Create(ctx context.Context, n *Notification) error
+	// CreateMany saves new notifications and their outbox entries all at once:
+	// either every one is saved or none is.
+	CreateMany(ctx context.Context, ns []*Notification) error
+	// Get returns a copy of the notification with the given ID.
+	Get(ctx context.Context, id string) (*Notification, error)
+	// Update overwrites a stored notification.
+	Update(ctx context.Context, n *Notification) error
+	// UpdateClaimed overwrites a notification that owner claimed at n.Version.
+	// It returns ErrStatusConflict if the notification is no longer sending
+	// under that claim, e.g. because the claim was released as stale.
+	UpdateClaimed(ctx context.Context, n *Notification, owner string) error
+	// UpdateStatus sets the status to `to` only if the current status is `from`.
+	UpdateStatus(ctx context.Context, id, from, to string) error
+	// Claim moves a pending notification to "sending" if it is still at version,
+	// or at any version when version is 0, recording owner and at as the claim.
+	Claim(ctx context.Context, id string, version int, owner string, at time.Time) error
+	// ReleaseStaleClaims moves notifications that were claimed before
+	// claimedBefore, or without a recorded claim time, back to pending under a
+	// new version, writing its outbox entry in the same transaction. It
+	// returns the released notifications.
+	ReleaseStaleClaims(ctx context.Context, claimedBefore time.Time) ([]*Notification, error)
+	// UpdatePending writes the editable fields of n (message, channel, target,
+	// send_at and timezone) and its new version, if the stored notification is
+	// still pending at version. An outbox entry for the new version is written
+	// in the same transaction.
+	UpdatePending(ctx context.Context, n *Notification, version int) error
+	// List returns the notifications matching the filter, ordered by send time.
+	List(ctx context.Context, filter NotificationFilter) ([]*Notification, error)
+	// CountByStatus counts the notifications matching the filter per status. Limit and the cursor are ignored.
+	CountByStatus(ctx context.Context, filter NotificationFilter) (map[string]int, error)
+
+	// ListOutbox returns up to limit outbox entries created before `before`
+	// that are not done yet, oldest first.
+	ListOutbox(ctx context.Context, before time.Time, limit int) ([]OutboxEntry, error)
+	// MarkOutboxDone marks outbox entries as handed to the scheduler.
+	MarkOutboxDone(ctx context.Context, entries []OutboxEntry) error
+
+	// AddStatusChange appends to a notification's status history.
+	AddStatusChange(ctx context.Context, notificationID string, change StatusChange) error
+	// ListStatusChanges returns a notification's status history, oldest first.
+	ListStatusChanges(ctx context.Context, notificationID string) ([]StatusChange, error)
+	// AddAttempt appends to a notification's delivery attempts.
+	AddAttempt(ctx context.Context, notificationID string, attempt DeliveryAttempt) error
+	// ListAttempts returns a notification's delivery attempts, oldest first.
+	ListAttempts(ctx context.Context, notificationID string) ([]DeliveryAttempt, error)
+
+	// CreateSeries saves a new recurring series.
+	CreateSeries(ctx context.Context, series *Series) error
+	// GetSeries returns the series with the given ID.
+	GetSeries(ctx context.Context, id string) (*Series, error)
+	// UpdateSeries overwrites a stored series.
+	UpdateSeries(ctx context.Context, series *Series) error
+
+	// SaveTemplate creates or replaces a tenant's message template.
+	SaveTemplate(ctx context.Context, t *Template) error
+	// GetTemplate returns the tenant's template with the given ID.
+	GetTemplate(ctx context.Context, tenantID, id string) (*Template, error)
+
+	// SavePreferences creates or replaces a user's preferences.
+	SavePreferences(ctx context.Context, prefs *UserPreferences) error
+	// GetPreferences returns the preferences of a tenant's user.
+	GetPreferences(ctx context.Context, tenantID, userID string) (*UserPreferences, error)
+
+	// AddDeadLetter records a failed notification, replacing an earlier record for it.
+	AddDeadLetter(ctx context.Context, dl *DeadLetter) error
+	// ListDeadLetters returns dead letters with their notifications, oldest first.
+	ListDeadLetters(ctx context.Context) ([]*DeadLetter, error)
+	// RemoveDeadLetter deletes the dead letter for a notification.
+	RemoveDeadLetter(ctx context.Context, notificationID string) error
+
+	// Close releases resources held by the store.
+	Close() error
+}
+
+// NotificationFilter selects notifications in List. Empty fields match everything.
+type NotificationFilter struct {
+	TenantID string
+	SeriesID string
+	BatchID  string
+	Status   string
+	UserID   string
+	Channel  string
+	// From and To bound send_at to [From, To).
+	From time.Time
+	To   time.Time
+	// AfterSendAt and AfterID continue a listing after the notification last
+	// seen, in (send_at, id) order.
+	AfterSendAt time.Time
+	AfterID     string
+	// Limit caps the number of results; 0 means no limit.
+	Limit int
+}
+
+// match reports whether n passes the filter.
+func (f NotificationFilter) match(n *Notification) bool {
+	return (f.TenantID == "" || n.TenantID == f.TenantID) &&
+		(f.SeriesID == "" || n.SeriesID == f.SeriesID) &&
+		(f.BatchID == "" || n.BatchID == f.BatchID) &&
+		(f.Status == "" || n.Status == f.Status) &&
+		(f.UserID == "" || n.UserID == f.UserID) &&
+		(f.Channel == "" || n.Channel == f.Channel) &&
+		(f.From.IsZero() || !n.SendAt.Before(f.From)) &&
+		(f.To.IsZero() || n.SendAt.Before(f.To)) &&
+		(f.AfterID == "" || n.SendAt.After(f.AfterSendAt) || (n.SendAt.Equal(f.AfterSendAt) && n.ID > f.AfterID))
+}
+
+// MemoryStore keeps notifications in memory. It is meant for tests and local runs.
+type MemoryStore struct {
+	mu            sync.RWMutex
+	notifications map[string]*Notification
+	deadLetters   map[string]*DeadLetter
+	series        map[string]*Series
+	history       map[string][]StatusChange
+	attempts      map[string][]DeliveryAttempt
+	templates     map[templateKey]*Template
+	preferences   map[preferencesKey]*UserPreferences
+	outbox        []*memoryOutboxEntry
+}
+
+// preferencesKey identifies a user's preferences in the MemoryStore. User IDs
+// are only unique within a tenant.
+type preferencesKey struct {
+	tenantID, userID string
+}
+
+// templateKey identifies a template in the MemoryStore. Template IDs are only
+// unique within a tenant.
+type templateKey struct {
+	tenantID, id string
+}
+
+// memoryOutboxEntry is an outbox entry of the MemoryStore.
+type memoryOutboxEntry struct {
+	OutboxEntry
+	done bool
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		notifications: make(map[string]*Notification),
+		deadLetters:   make(map[string]*DeadLetter),
+		series:        make(map[string]*Series),
+		history:       make(map[string][]StatusChange),
+		attempts:      make(map[string][]DeliveryAttempt),
+		templates:     make(map[templateKey]*Template),
+		preferences:   make(map[preferencesKey]*UserPreferences),
+	}
+}
+
+// Create saves a new notification.
+func (s *MemoryStore) Create(ctx context.Context, n *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.notifications[n.ID]; ok {
+		return fmt.Errorf("notification %s already exists", n.ID)
+	}
+	c := *n
+	s.notifications[n.ID] = &c
+	s.addOutbox(n)
+	return nil
+}
+
+// addOutbox appends the outbox entry of the notification's current version.
+// The caller holds the lock.
+func (s *MemoryStore) addOutbox(n *Notification) {
+	s.outbox = append(s.outbox, &memoryOutboxEntry{
+		OutboxEntry: OutboxEntry{NotificationID: n.ID, Version: n.Version, CreatedAt: time.Now()},
+	})
+}
+
+// CreateMany saves new notifications all at once.
+func (s *MemoryStore) CreateMany(ctx context.Context, ns []*Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range ns {
+		if _, ok := s.notifications[n.ID]; ok {
+			return fmt.Errorf("notification %s already exists", n.ID)
+		}
+	}
+	for _, n := range ns {
+		c := *n
+		s.notifications[n.ID] = &c
+		s.addOutbox(n)
+	}
+	return nil
+}
+
+// Get returns a copy of the notification with the given ID.
+func (s *MemoryStore) Get(ctx context.Context, id string) (*Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n, ok := s.notifications[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *n
+	return &c, nil
+}
+
+// Update overwrites a stored notification.
+func (s *MemoryStore) Update(ctx context.Context, n *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.notifications[n.ID]; !ok {
+		return ErrNotFound
+	}
+	c := *n
+	s.notifications[n.ID] = &c
+	return nil
+}
+
+// UpdateClaimed overwrites a notification that owner claimed at n.Version.
+func (s *MemoryStore) UpdateClaimed(ctx context.Context, n *Notification, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.notifications[n.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Status != "sending" || stored.ClaimedBy != owner || stored.Version != n.Version {
+		return ErrStatusConflict
+	}
+	c := *n
+	s.notifications[n.ID] = &c
+	return nil
+}
+
+// UpdateStatus sets the status to `to` only if the current status is `from`.
+func (s *MemoryStore) UpdateStatus(ctx context.Context, id, from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.notifications[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if n.Status != from {
+		return ErrStatusConflict
+	}
+	n.Status = to
+	return nil
+}
+
+// Claim moves a pending notification at version to "sending".
+func (s *MemoryStore) Claim(ctx context.Context, id string, version int, owner string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.notifications[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if n.Status != "pending" || (version != 0 && n.Version != version) {
+		return ErrStatusConflict
+	}
+	n.Status = "sending"
+	n.ClaimedBy, n.ClaimedAt = owner, &at
+	return nil
+}
+
+// ReleaseStaleClaims moves stale "sending" notifications back to pending under a new version.
+func (s *MemoryStore) ReleaseStaleClaims(ctx context.Context, claimedBefore time.Time) ([]*Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	released := []*Notification{}
+	for _, n := range s.notifications {
+		if n.Status != "sending" || (n.ClaimedAt != nil && !n.ClaimedAt.Before(claimedBefore)) {
+			continue
+		}
+		n.Status = "pending"
+		n.Version++
+		s.addOutbox(n)
+		c := *n
+		released = append(released, &c)
+	}
+	return released, nil
+}
+
+// UpdatePending overwrites a notification that is pending at version.
+func (s *MemoryStore) UpdatePending(ctx context.Context, n *Notification, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.notifications[n.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Status != "pending" || stored.Version != version {
+		return ErrStatusConflict
+	}
+	stored.Message, stored.Channel, stored.Target = n.Message, n.Channel, n.Target
+	stored.SendAt, stored.OriginalSendAt, stored.Timezone, stored.Version = n.SendAt, n.OriginalSendAt, n.Timezone, n.Version
+	s.addOutbox(n)
+	return nil
+}
+
+// List returns the notifications matching the filter, ordered by send time.
+func (s *MemoryStore) List(ctx context.Context, filter NotificationFilter) ([]*Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []*Notification{}
+	for _, n := range s.notifications {
+		if filter.match(n) {
+			c := *n
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].SendAt.Equal(list[j].SendAt) {
+			return list[i].SendAt.Before(list[j].SendAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	if filter.Limit > 0 && len(list) > filter.Limit {
+		list = list[:filter.Limit]
+	}
+	return list, nil
+}
+
+// CountByStatus counts the notifications matching the filter per status.
+func (s *MemoryStore) CountByStatus(ctx context.Context, filter NotificationFilter) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	filter.AfterID = ""
+	counts := make(map[string]int)
+	for _, n := range s.notifications {
+		if filter.match(n) {
+			counts[n.Status]++
+		}
+	}
+	return counts, nil
+}
+
+// AddStatusChange appends to a notification's status history.
+func (s *MemoryStore) AddStatusChange(ctx context.Context, notificationID string, change StatusChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history[notificationID] = append(s.history[notificationID], change)
+	return nil
+}
+
+// ListStatusChanges returns a notification's status history, oldest first.
+func (s *MemoryStore) ListStatusChanges(ctx context.Context, notificationID string) ([]StatusChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]StatusChange{}, s.history[notificationID]...), nil
+}
+
+// AddAttempt appends to a notification's delivery attempts.
+func (s *MemoryStore) AddAttempt(ctx context.Context, notificationID string, attempt DeliveryAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts[notificationID] = append(s.attempts[notificationID], attempt)
+	return nil
+}
+
+// ListAttempts returns a notification's delivery attempts, oldest first.
+func (s *MemoryStore) ListAttempts(ctx context.Context, notificationID string) ([]DeliveryAttempt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]DeliveryAttempt{}, s.attempts[notificationID]...), nil
+}
+
+// CreateSeries saves a new recurring series.
+func (s *MemoryStore) CreateSeries(ctx context.Context, series *Series) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.series[series.ID]; ok {
+		return fmt.Errorf("series %s already exists", series.ID)
+	}
+	c := *series
+	s.series[series.ID] = &c
+	return nil
+}
+
+// GetSeries returns the series with the given ID.
+func (s *MemoryStore) GetSeries(ctx context.Context, id string) (*Series, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	series, ok := s.series[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *series
+	return &c, nil
+}
+
+// UpdateSeries overwrites a stored series.
+func (s *MemoryStore) UpdateSeries(ctx context.Context, series *Series) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.series[series.ID]; !ok {
+		return ErrNotFound
+	}
+	c := *series
+	s.series[series.ID] = &c
+	return nil
+}
+
+// SaveTemplate creates or replaces a tenant's message template.
+func (s *MemoryStore) SaveTemplate(ctx context.Context, t *Template) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *t
+	s.templates[templateKey{t.TenantID, t.ID}] = &c
+	return nil
+}
+
+// GetTemplate returns the tenant's template with the given ID.
+func (s *MemoryStore) GetTemplate(ctx context.Context, tenantID, id string) (*Template, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.templates[templateKey{tenantID, id}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *t
+	return &c, nil
+}
+
+// SavePreferences creates or replaces a user's preferences.
+func (s *MemoryStore) SavePreferences(ctx context.Context, prefs *UserPreferences) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *prefs
+	s.preferences[preferencesKey{prefs.TenantID, prefs.UserID}] = &c
+	return nil
+}
+
+// GetPreferences returns the preferences of a tenant's user.
+func (s *MemoryStore) GetPreferences(ctx context.Context, tenantID, userID string) (*UserPreferences, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefs, ok := s.preferences[preferencesKey{tenantID, userID}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *prefs
+	return &c, nil
+}
+
+// AddDeadLetter records a failed notification.
+func (s *MemoryStore) AddDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *dl
+	c.Notification = nil
+	s.deadLetters[dl.NotificationID] = &c
+	return nil
+}
+
+// ListDeadLetters returns dead letters with their notifications, oldest first.
+func (s *MemoryStore) ListDeadLetters(ctx context.Context) ([]*DeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	letters := make([]*DeadLetter, 0, len(s.deadLetters))
+	for _, dl := range s.deadLetters {
+		c := *dl
+		if n, ok := s.notifications[dl.NotificationID]; ok {
+			nc := *n
+			c.Notification = &nc
+		}
+		letters = append(letters, &c)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+	return letters, nil
+}
+
+// RemoveDeadLetter deletes the dead letter for a notification.
+func (s *MemoryStore) RemoveDeadLetter(ctx context.Context, notificationID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deadLetters[notificationID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.deadLetters, notificationID)
+	return nil
+}
+
+// ListOutbox returns the outbox entries created before `before` that are not done.
+func (s *MemoryStore) ListOutbox(ctx context.Context, before time.Time, limit int) ([]OutboxEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []OutboxEntry
+	for _, e := range s.outbox {
+		if len(entries) == limit {
+			break
+		}
+		if !e.done && e.CreatedAt.Before(before) {
+			entries = append(entries, e.OutboxEntry)
+		}
+	}
+	return entries, nil
+}
+
+// MarkOutboxDone marks outbox entries as handed to the scheduler.
+func (s *MemoryStore) MarkOutboxDone(ctx context.Context, entries []OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, done := range entries {
+		for _, e := range s.outbox {
+			if e.NotificationID == done.NotificationID && e.Version == done.Version {
+				e.done = true
+			}
+		}
+	}
+	return nil
+}
+
+// Close does nothing for the in-memory store.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// notificationColumns lists the notification columns in the order scanNotification reads them.
+const notificationColumns = `n.id, n.user_id, n.message, n.template_id, n.template_data, n.channel, n.target,
+	n.send_at, n.timezone, n.status, n.retries, n.last_error, n.series_id, n.batch_id, n.created_at, n.last_attempt_at,
+	n.sent_at, n.version, n.tenant_id, n.priority, n.claimed_by, n.claimed_at, n.original_send_at`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanNotification reads the columns listed in notificationColumns.
+func scanNotification(row rowScanner, extra ...any) (*Notification, error) {
+	var n Notification
+	var templateData string
+	var lastAttemptAt, sentAt, claimedAt, originalSendAt sql.NullTime
+	dest := []any{&n.ID, &n.UserID, &n.Message, &n.TemplateID, &templateData, &n.Channel, &n.Target,
+		&n.SendAt, &n.Timezone, &n.Status, &n.Retries, &n.LastError, &n.SeriesID, &n.BatchID, &n.CreatedAt, &lastAttemptAt,
+		&sentAt, &n.Version, &n.TenantID, &n.Priority, &n.ClaimedBy, &claimedAt, &originalSendAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if err := unmarshalData(templateData, &n.TemplateData); err != nil {
+		return nil, err
+	}
+	if lastAttemptAt.Valid {
+		n.LastAttemptAt = &lastAttemptAt.Time
+	}
+	if sentAt.Valid {
+		n.SentAt = &sentAt.Time
+	}
+	if claimedAt.Valid {
+		n.ClaimedAt = &claimedAt.Time
+	}
+	// Rows from before original_send_at existed only know their current send_at.
+	n.OriginalSendAt = n.SendAt
+	if originalSendAt.Valid && !originalSendAt.Time.IsZero() {
+		n.OriginalSendAt = originalSendAt.Time
+	}
+	return &n, nil
+}
+
+// marshalData encodes template data for a TEXT column.
+func marshalData(data map[string]any) (string, error) {
+	if len(data) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode template data: %v", err)
+	}
+	return string(b), nil
+}
+
+// unmarshalData reverses marshalData.
+func unmarshalData(s string, data *map[string]any) error {
+	if s == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(s), data); err != nil {
+		return fmt.Errorf("failed to decode template data: %v", err)
+	}
+	return nil
+}
+
+// nullableUTC converts an optional timestamp to a query argument.
+func nullableUTC(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+// SQLStore keeps notifications in a SQL database. The queries work with both
+// PostgreSQL (lib/pq) and SQLite (go-sqlite3).
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates a SQLStore and makes sure the schema exists.
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	s := &SQLStore{db: db}
+	if err := s.initDB(); err != nil {
+		return nil, fmt.Errorf("failed to init notification store: %v", err)
+	}
+	return s, nil
+}
+
+// initDB creates the tables, brings those of an older version up to date and
+// then creates the indexes, which may cover columns the migration added.
+func (s *SQLStore) initDB() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS notifications (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			message TEXT NOT NULL,
+			template_id TEXT NOT NULL DEFAULT '',
+			template_data TEXT NOT NULL DEFAULT '',
+			channel TEXT NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			send_at TIMESTAMP NOT NULL,
+			timezone TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			retries INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			series_id TEXT NOT NULL DEFAULT '',
+			batch_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			last_attempt_at TIMESTAMP,
+			sent_at TIMESTAMP,
+			version INTEGER NOT NULL DEFAULT 1,
+			tenant_id TEXT NOT NULL DEFAULT '',
+			priority TEXT NOT NULL DEFAULT 'normal',
+			claimed_by TEXT NOT NULL DEFAULT '',
+			claimed_at TIMESTAMP,
+			original_send_at TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS notification_history (
+			notification_id TEXT NOT NULL REFERENCES notifications(id),
+			seq INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS delivery_attempts (
+			notification_id TEXT NOT NULL REFERENCES notifications(id),
+			seq INTEGER NOT NULL,
+			attempt INTEGER NOT NULL,
+			channel TEXT NOT NULL,
+			response TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS outbox (
+			notification_id TEXT NOT NULL REFERENCES notifications(id),
+			version INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			done_at TIMESTAMP,
+			PRIMARY KEY (notification_id, version)
+		);
+		CREATE TABLE IF NOT EXISTS dead_letters (
+			notification_id TEXT PRIMARY KEY REFERENCES notifications(id),
+			error TEXT NOT NULL,
+			failed_at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS series (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			message TEXT NOT NULL,
+			template_id TEXT NOT NULL DEFAULT '',
+			template_data TEXT NOT NULL DEFAULT '',
+			channel TEXT NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			schedule TEXT NOT NULL,
+			timezone TEXT NOT NULL DEFAULT '',
+			active BOOLEAN NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			tenant_id TEXT NOT NULL DEFAULT '',
+			priority TEXT NOT NULL DEFAULT 'normal'
+		);
+	` + templatesTable + userPreferencesTable)
+	if err != nil {
+		return err
+	}
+	if err := s.migrate(); err != nil {
+		return fmt.Errorf("failed to migrate: %v", err)
+	}
+	_, err = s.db.Exec(`
+		CREATE INDEX IF NOT EXISTS notifications_series_idx ON notifications (series_id);
+		CREATE INDEX IF NOT EXISTS notifications_batch_idx ON notifications (batch_id);
+		CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications (user_id, send_at, id);
+		CREATE INDEX IF NOT EXISTS notifications_tenant_idx ON notifications (tenant_id, send_at, id);
+		CREATE INDEX IF NOT EXISTS notifications_claim_idx ON notifications (status, claimed_at);
+		CREATE INDEX IF NOT EXISTS notifications_due_idx ON notifications (status, send_at, id);
+		CREATE INDEX IF NOT EXISTS notification_history_idx ON notification_history (notification_id, seq);
+		CREATE INDEX IF NOT EXISTS delivery_attempts_idx ON delivery_attempts (notification_id, seq);
+		CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (done_at, created_at);
+	`)
+	return err
+}
+
+// templatesTable creates the templates table. Like userPreferencesTable, it is
+// also used to rebuild the table of an older version under its new primary key.
+const templatesTable = `
+	CREATE TABLE IF NOT EXISTS templates (
+		tenant_id TEXT NOT NULL DEFAULT '',
+		id TEXT NOT NULL,
+		default_locale TEXT NOT NULL,
+		variants TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (tenant_id, id)
+	);
+`
+
+// userPreferencesTable creates the user_preferences table. migrate uses it
+// too, to rebuild the table of an older version under its new primary key.
+const userPreferencesTable = `
+	CREATE TABLE IF NOT EXISTS user_preferences (
+		tenant_id TEXT NOT NULL DEFAULT '',
+		user_id TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		telegram_chat_id TEXT NOT NULL DEFAULT '',
+		channels TEXT NOT NULL DEFAULT '',
+		locale TEXT NOT NULL DEFAULT '',
+		timezone TEXT NOT NULL DEFAULT '',
+		quiet_start TEXT NOT NULL DEFAULT '',
+		quiet_end TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (tenant_id, user_id)
+	);
+`
+
+// addedColumns lists the columns added to each table after it was first
+// created, oldest first. migrate adds those an older database lacks.
+var addedColumns = []struct{ table, column, definition string }{
+	{"notifications", "target", "TEXT NOT NULL DEFAULT ''"},
+	{"notifications", "last_error", "TEXT NOT NULL DEFAULT ''"},
+	{"notifications", "series_id", "TEXT NOT NULL DEFAULT ''"},
+	{"notifications", "timezone", "TEXT NOT NULL DEFAULT ''"},
+	{"notifications", "last_attempt_at", "TIMESTAMP"},
+	{"notifications", "sent_at", "TIMESTAMP"},
+	{"notifications", "template_id", "TEXT NOT NULL DEFAULT ''"},
+	{"notifications", "template_data", "TEXT NOT NULL DEFAULT ''"},
+	{"notifications", "batch_id", "TEXT NOT NULL DEFAULT ''"},
+	{"notifications", "version", "INTEGER NOT NULL DEFAULT 1"},
+	{"notifications", "tenant_id", "TEXT NOT NULL DEFAULT ''"},
+	{"notifications", "priority", "TEXT NOT NULL DEFAULT 'normal'"},
+	{"notifications", "claimed_by", "TEXT NOT NULL DEFAULT ''"},
+	{"notifications", "claimed_at", "TIMESTAMP"},
+	{"notifications", "original_send_at", "TIMESTAMP"},
+	{"series", "template_id", "TEXT NOT NULL DEFAULT ''"},
+	{"series", "template_data", "TEXT NOT NULL DEFAULT ''"},
+	{"series", "tenant_id", "TEXT NOT NULL DEFAULT ''"},
+	{"series", "priority", "TEXT NOT NULL DEFAULT 'normal'"},
+	{"user_preferences", "email", "TEXT NOT NULL DEFAULT ''"},
+	{"user_preferences", "telegram_chat_id", "TEXT NOT NULL DEFAULT ''"},
+	{"user_preferences", "channels", "TEXT NOT NULL DEFAULT ''"},
+	{"user_preferences", "timezone", "TEXT NOT NULL DEFAULT ''"},
+	{"user_preferences", "quiet_start", "TEXT NOT NULL DEFAULT ''"},
+	{"user_preferences", "quiet_end", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// migrate adds the columns an older database lacks and rekeys templates and
+// user_preferences by tenant. It only changes what is missing, so running it
+// again does nothing.
+func (s *SQLStore) migrate() error {
+	tables := make(map[string]map[string]bool)
+	for _, c := range addedColumns {
+		if tables[c.table] == nil {
+			columns, err := s.columns(c.table)
+			if err != nil {
+				return err
+			}
+			tables[c.table] = columns
+		}
+		if tables[c.table][c.column] {
+			continue
+		}
+		if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %v", c.table, c.column, err)
+		}
+		tables[c.table][c.column] = true
+	}
+	if columns, err := s.columns("templates"); err != nil {
+		return err
+	} else if !columns["tenant_id"] {
+		if err := s.rekey("templates", templatesTable, `id, default_locale, variants, updated_at`); err != nil {
+			return err
+		}
+	}
+	if !tables["user_preferences"]["tenant_id"] {
+		return s.rekey("user_preferences", userPreferencesTable,
+			`user_id, email, telegram_chat_id, channels, locale, timezone, quiet_start, quiet_end, updated_at`)
+	}
+	return nil
+}
+
+// columns returns the names of the columns of table.
+func (s *SQLStore) columns(table string) (map[string]bool, error) {
+	rows, err := s.db.Query("SELECT * FROM " + table + " LIMIT 0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %v", table, err)
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %v", table, err)
+	}
+	columns := make(map[string]bool, len(names))
+	for _, name := range names {
+		columns[name] = true
+	}
+	return columns, nil
+}
+
+// rekey rebuilds a table of an older version, which lacks tenant_id, with
+// create and copies columns over. Existing rows keep the empty tenant.
+func (s *SQLStore) rekey(table, create, columns string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		// A copy rather than a rename, which would keep the old primary key's name taken on PostgreSQL.
+		`CREATE TABLE ` + table + `_old AS SELECT * FROM ` + table,
+		`DROP TABLE ` + table,
+		create,
+		`INSERT INTO ` + table + ` (` + columns + `) SELECT ` + columns + ` FROM ` + table + `_old`,
+		`DROP TABLE ` + table + `_old`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to rekey %s: %v", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// insertNotification is the statement Create and CreateMany use.
+const insertNotification = `
+	INSERT INTO notifications (id, user_id, message, template_id, template_data, channel, target, send_at, timezone,
+		status, retries, series_id, batch_id, created_at, version, tenant_id, priority, original_send_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)`
+
+// insertArgs returns the arguments of insertNotification.
+func insertArgs(n *Notification) ([]any, error) {
+	data, err := marshalData(n.TemplateData)
+	if err != nil {
+		return nil, err
+	}
+	return []any{n.ID, n.UserID, n.Message, n.TemplateID, data, n.Channel, n.Target, n.SendAt.UTC(), n.Timezone,
+		n.Status, n.Retries, n.SeriesID, n.BatchID, n.CreatedAt.UTC(), n.Version, n.TenantID, n.Priority,
+		nullableUTC(&n.OriginalSendAt)}, nil
+}
+
+// insertOutbox is the statement that adds an outbox entry.
+const insertOutbox = "INSERT INTO outbox (notification_id, version, created_at) VALUES ($1, $2, $3)"
+
+// Create saves a new notification and its outbox entry in one transaction.
+func (s *SQLStore) Create(ctx context.Context, n *Notification) error {
+	args, err := insertArgs(n)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, insertNotification, args...); err != nil {
+		return fmt.Errorf("failed to save notification: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, insertOutbox, n.ID, n.Version, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to save outbox entry: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit notification: %v", err)
+	}
+	return nil
+}
+
+// CreateMany saves new notifications in one transaction.
+func (s *SQLStore) CreateMany(ctx context.Context, ns []*Notification) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, insertNotification)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %v", err)
+	}
+	defer stmt.Close()
+	outboxStmt, err := tx.PrepareContext(ctx, insertOutbox)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %v", err)
+	}
+	defer outboxStmt.Close()
+	now := time.Now().UTC()
+	for _, n := range ns {
+		args, err := insertArgs(n)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("failed to save notification %s: %v", n.ID, err)
+		}
+		if _, err := outboxStmt.ExecContext(ctx, n.ID, n.Version, now); err != nil {
+			return fmt.Errorf("failed to save outbox entry of %s: %v", n.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit notifications: %v", err)
+	}
+	return nil
+}
+
+// Get returns the notification with the given ID.
+func (s *SQLStore) Get(ctx context.Context, id string) (*Notification, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+notificationColumns+" FROM notifications n WHERE n.id = $1", id)
+	n, err := scanNotification(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return n, nil
+}
+
+// Update overwrites a stored notification.
+func (s *SQLStore) Update(ctx context.Context, n *Notification) error {
+	args, err := updateArgs(n)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, updateNotification+` WHERE id = $18`, append(args, n.ID)...)
+	if err != nil {
+		return fmt.Errorf("failed to update notification: %v", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateClaimed overwrites a notification that owner claimed at n.Version.
+func (s *SQLStore) UpdateClaimed(ctx context.Context, n *Notification, owner string) error {
+	args, err := updateArgs(n)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, updateNotification+`
+		WHERE id = $18 AND status = 'sending' AND claimed_by = $19 AND version = $20`,
+		append(args, n.ID, owner, n.Version)...)
+	if err != nil {
+		return fmt.Errorf("failed to update notification: %v", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrStatusConflict
+	}
+	return nil
+}
+
+// updateNotification is the statement Update and UpdateClaimed complete with their WHERE clause.
+const updateNotification = `
+	UPDATE notifications
+	SET user_id = $1, message = $2, template_id = $3, template_data = $4, channel = $5, target = $6,
+		send_at = $7, timezone = $8, status = $9, retries = $10, last_error = $11, last_attempt_at = $12,
+		sent_at = $13, version = $14, claimed_by = $15, claimed_at = $16, original_send_at = $17`
+
+// updateArgs returns the arguments of updateNotification.
+func updateArgs(n *Notification) ([]any, error) {
+	data, err := marshalData(n.TemplateData)
+	if err != nil {
+		return nil, err
+	}
+	return []any{n.UserID, n.Message, n.TemplateID, data, n.Channel, n.Target,
+		n.SendAt.UTC(), n.Timezone, n.Status, n.Retries, n.LastError, nullableUTC(n.LastAttemptAt),
+		nullableUTC(n.SentAt), n.Version, n.ClaimedBy, nullableUTC(n.ClaimedAt), nullableUTC(&n.OriginalSendAt)}, nil
+}
+
+// UpdateStatus sets the status to `to` only if the current status is `from`.
+func (s *SQLStore) UpdateStatus(ctx context.Context, id, from, to string) error {
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE notifications SET status = $1 WHERE id = $2 AND status = $3", to, id, from)
+	if err != nil {
+		return fmt.Errorf("failed to update status: %v", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		if _, err := s.Get(ctx, id); err != nil {
+			return err
+		}
+		return ErrStatusConflict
+	}
+	return nil
+}
+
+// Claim moves a pending notification at version to "sending".
+func (s *SQLStore) Claim(ctx context.Context, id string, version int, owner string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE notifications SET status = 'sending', claimed_by = $1, claimed_at = $2
+		WHERE id = $3 AND status = 'pending' AND ($4 = 0 OR version = $4)`,
+		owner, at.UTC(), id, version)
+	if err != nil {
+		return fmt.Errorf("failed to claim notification: %v", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		if _, err := s.Get(ctx, id); err != nil {
+			return err
+		}
+		return ErrStatusConflict
+	}
+	return nil
+}
+
+// ReleaseStaleClaims moves stale "sending" notifications back to pending under
+// a new version and adds the outbox entries of the new versions, all in one
+// transaction.
+func (s *SQLStore) ReleaseStaleClaims(ctx context.Context, claimedBefore time.Time) ([]*Notification, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "SELECT "+notificationColumns+` FROM notifications n
+		WHERE n.status = 'sending' AND (n.claimed_at IS NULL OR n.claimed_at < $1)`, claimedBefore.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stale claims: %v", err)
+	}
+	var stale []*Notification
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan notification: %v", err)
+		}
+		stale = append(stale, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list stale claims: %v", err)
+	}
+
+	released := []*Notification{}
+	now := time.Now().UTC()
+	for _, n := range stale {
+		// The worker may have settled the notification since it was listed.
+		res, err := tx.ExecContext(ctx,
+			"UPDATE notifications SET status = 'pending', version = $1 WHERE id = $2 AND status = 'sending' AND version = $3",
+			n.Version+1, n.ID, n.Version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to release notification %s: %v", n.ID, err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			continue
+		}
+		n.Status = "pending"
+		n.Version++
+		if _, err := tx.ExecContext(ctx, insertOutbox, n.ID, n.Version, now); err != nil {
+			return nil, fmt.Errorf("failed to save outbox entry of %s: %v", n.ID, err)
+		}
+		released = append(released, n)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit released claims: %v", err)
+	}
+	return released, nil
+}
+
+// UpdatePending overwrites a notification that is pending at version and adds
+// the outbox entry of the new version in the same transaction.
+func (s *SQLStore) UpdatePending(ctx context.Context, n *Notification, version int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `
+		UPDATE notifications
+		SET message = $1, channel = $2, target = $3, send_at = $4, timezone = $5, version = $6, original_send_at = $7
+		WHERE id = $8 AND status = 'pending' AND version = $9`,
+		n.Message, n.Channel, n.Target, n.SendAt.UTC(), n.Timezone, n.Version, nullableUTC(&n.OriginalSendAt), n.ID, version)
+	if err != nil {
+		return fmt.Errorf("failed to update notification: %v", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		tx.Rollback()
+		if _, err := s.Get(ctx, n.ID); err != nil {
+			return err
+		}
+		return ErrStatusConflict
+	}
+	if _, err := tx.ExecContext(ctx, insertOutbox, n.ID, n.Version, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to save outbox entry: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit notification: %v", err)
+	}
+	return nil
+}
+
+// where builds the WHERE clause for a filter, numbering parameters from $1.
+func (f NotificationFilter) where() (string, []any) {
+	clause := "WHERE 1 = 1"
+	var args []any
+	add := func(cond string, vals ...any) {
+		params := make([]any, len(vals))
+		for i, v := range vals {
+			args = append(args, v)
+			params[i] = len(args)
+		}
+		clause += fmt.Sprintf(" AND "+cond, params...)
+	}
+	if f.TenantID != "" {
+		add("n.tenant_id = $%d", f.TenantID)
+	}
+	if f.SeriesID != "" {
+		add("n.series_id = $%d", f.SeriesID)
+	}
+	if f.BatchID != "" {
+		add("n.batch_id = $%d", f.BatchID)
+	}
+	if f.Status != "" {
+		add("n.status = $%d", f.Status)
+	}
+	if f.UserID != "" {
+		add("n.user_id = $%d", f.UserID)
+	}
+	if f.Channel != "" {
+		add("n.channel = $%d", f.Channel)
+	}
+	if !f.From.IsZero() {
+		add("n.send_at >= $%d", f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		add("n.send_at < $%d", f.To.UTC())
+	}
+	if f.AfterID != "" {
+		after := f.AfterSendAt.UTC()
+		add("(n.send_at > $%d OR (n.send_at = $%d AND n.id > $%d))", after, after, f.AfterID)
+	}
+	return clause, args
+}
+
+// List returns the notifications matching the filter, ordered by send time.
+func (s *SQLStore) List(ctx context.Context, filter NotificationFilter) ([]*Notification, error) {
+	where, args := filter.where()
+	query := "SELECT " + notificationColumns + " FROM notifications n " + where + " ORDER BY n.send_at, n.id"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notifications: %v", err)
+	}
+	defer rows.Close()
+
+	list := []*Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %v", err)
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// CountByStatus counts the notifications matching the filter per status.
+func (s *SQLStore) CountByStatus(ctx context.Context, filter NotificationFilter) (map[string]int, error) {
+	filter.AfterID = ""
+	where, args := filter.where()
+	rows, err := s.db.QueryContext(ctx, "SELECT n.status, COUNT(*) FROM notifications n "+where+" GROUP BY n.status", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count notifications: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan count: %v", err)
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+// AddStatusChange appends to a notification's status history.
+func (s *SQLStore) AddStatusChange(ctx context.Context, notificationID string, change StatusChange) error {
+	// seq keeps the order stable when several changes share a timestamp.
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO notification_history (notification_id, seq, status, reason, at)
+		VALUES ($1, (SELECT COALESCE(MAX(seq), 0) + 1 FROM notification_history WHERE notification_id = $1), $2, $3, $4)`,
+		notificationID, change.Status, change.Reason, change.At.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save status change: %v", err)
+	}
+	return nil
+}
+
+// ListStatusChanges returns a notification's status history, oldest first.
+func (s *SQLStore) ListStatusChanges(ctx context.Context, notificationID string) ([]StatusChange, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT status, reason, at FROM notification_history WHERE notification_id = $1 ORDER BY seq", notificationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query status history: %v", err)
+	}
+	defer rows.Close()
+
+	history := []StatusChange{}
+	for rows.Next() {
+		var c StatusChange
+		if err := rows.Scan(&c.Status, &c.Reason, &c.At); err != nil {
+			return nil, fmt.Errorf("failed to scan status change: %v", err)
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+// AddAttempt appends to a notification's delivery attempts.
+func (s *SQLStore) AddAttempt(ctx context.Context, notificationID string, attempt DeliveryAttempt) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO delivery_attempts (notification_id, seq, attempt, channel, response, error, at)
+		VALUES ($1, (SELECT COALESCE(MAX(seq), 0) + 1 FROM delivery_attempts WHERE notification_id = $1), $2, $3, $4, $5, $6)`,
+		notificationID, attempt.Attempt, attempt.Channel, attempt.Response, attempt.Error, attempt.At.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save delivery attempt: %v", err)
+	}
+	return nil
+}
+
+// ListAttempts returns a notification's delivery attempts, oldest first.
+func (s *SQLStore) ListAttempts(ctx context.Context, notificationID string) ([]DeliveryAttempt, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT attempt, channel, response, error, at FROM delivery_attempts WHERE notification_id = $1 ORDER BY seq",
+		notificationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query delivery attempts: %v", err)
+	}
+	defer rows.Close()
+
+	attempts := []DeliveryAttempt{}
+	for rows.Next() {
+		var a DeliveryAttempt
+		if err := rows.Scan(&a.Attempt, &a.Channel, &a.Response, &a.Error, &a.At); err != nil {
+			return nil, fmt.Errorf("failed to scan delivery attempt: %v", err)
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// CreateSeries saves a new recurring series.
+func (s *SQLStore) CreateSeries(ctx context.Context, series *Series) error {
+	data, err := marshalData(series.TemplateData)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO series (id, user_id, message, template_id, template_data, channel, target, schedule, timezone,
+			active, created_at, tenant_id, priority)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		series.ID, series.UserID, series.Message, series.TemplateID, data, series.Channel, series.Target,
+		series.Schedule, series.Timezone, series.Active, series.CreatedAt.UTC(), series.TenantID, series.Priority)
+	if err != nil {
+		return fmt.Errorf("failed to save series: %v", err)
+	}
+	return nil
+}
+
+// GetSeries returns the series with the given ID.
+func (s *SQLStore) GetSeries(ctx context.Context, id string) (*Series, error) {
+	var series Series
+	var data string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, user_id, message, template_id, template_data, channel, target, schedule, timezone, active, created_at,
+			tenant_id, priority
+		FROM series WHERE id = $1`, id).
+		Scan(&series.ID, &series.UserID, &series.Message, &series.TemplateID, &data, &series.Channel, &series.Target,
+			&series.Schedule, &series.Timezone, &series.Active, &series.CreatedAt, &series.TenantID, &series.Priority)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if err := unmarshalData(data, &series.TemplateData); err != nil {
+		return nil, err
+	}
+	return &series, nil
+}
+
+// UpdateSeries overwrites a stored series.
+func (s *SQLStore) UpdateSeries(ctx context.Context, series *Series) error {
+	data, err := marshalData(series.TemplateData)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE series
+		SET user_id = $1, message = $2, template_id = $3, template_data = $4, channel = $5, target = $6,
+			schedule = $7, timezone = $8, active = $9
+		WHERE id = $10`,
+		series.UserID, series.Message, series.TemplateID, data, series.Channel, series.Target,
+		series.Schedule, series.Timezone, series.Active, series.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update series: %v", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SaveTemplate creates or replaces a tenant's message template.
+func (s *SQLStore) SaveTemplate(ctx context.Context, t *Template) error {
+	variants, err := json.Marshal(t.Variants)
+	if err != nil {
+		return fmt.Errorf("failed to encode template variants: %v", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO templates (tenant_id, id, default_locale, variants, updated_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (tenant_id, id) DO UPDATE SET default_locale = excluded.default_locale, variants = excluded.variants,
+			updated_at = excluded.updated_at`,
+		t.TenantID, t.ID, t.DefaultLocale, string(variants), t.UpdatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save template: %v", err)
+	}
+	return nil
+}
+
+// GetTemplate returns the tenant's template with the given ID.
+func (s *SQLStore) GetTemplate(ctx context.Context, tenantID, id string) (*Template, error) {
+	var t Template
+	var variants string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT tenant_id, id, default_locale, variants, updated_at
+		FROM templates WHERE tenant_id = $1 AND id = $2`, tenantID, id).
+		Scan(&t.TenantID, &t.ID, &t.DefaultLocale, &variants, &t.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if err := json.Unmarshal([]byte(variants), &t.Variants); err != nil {
+		return nil, fmt.Errorf("failed to decode template variants: %v", err)
+	}
+	return &t, nil
+}
+
+// SavePreferences creates or replaces a user's preferences.
+func (s *SQLStore) SavePreferences(ctx context.Context, prefs *UserPreferences) error {
+	var quietStart, quietEnd string
+	if prefs.QuietHours != nil {
+		quietStart, quietEnd = prefs.QuietHours.Start, prefs.QuietHours.End
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO user_preferences (tenant_id, user_id, email, telegram_chat_id, channels, locale, timezone, quiet_start,
+			quiet_end, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (tenant_id, user_id) DO UPDATE SET email = excluded.email, telegram_chat_id = excluded.telegram_chat_id,
+			channels = excluded.channels, locale = excluded.locale, timezone = excluded.timezone,
+			quiet_start = excluded.quiet_start, quiet_end = excluded.quiet_end, updated_at = excluded.updated_at`,
+		prefs.TenantID, prefs.UserID, prefs.Email, prefs.TelegramChatID, strings.Join(prefs.Channels, ","), prefs.Locale, prefs.Timezone,
+		quietStart, quietEnd, prefs.UpdatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save preferences: %v", err)
+	}
+	return nil
+}
+
+// GetPreferences returns the preferences of a tenant's user.
+func (s *SQLStore) GetPreferences(ctx context.Context, tenantID, userID string) (*UserPreferences, error) {
+	var prefs UserPreferences
+	var channels, quietStart, quietEnd string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT tenant_id, user_id, email, telegram_chat_id, channels, locale, timezone, quiet_start, quiet_end, updated_at
+		FROM user_preferences WHERE tenant_id = $1 AND user_id = $2`, tenantID, userID).
+		Scan(&prefs.TenantID, &prefs.UserID, &prefs.Email, &prefs.TelegramChatID, &channels, &prefs.Locale, &prefs.Timezone,
+			&quietStart, &quietEnd, &prefs.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if channels != "" {
+		prefs.Channels = strings.Split(channels, ",")
+	}
+	if quietStart != "" || quietEnd != "" {
+		prefs.QuietHours = &QuietHours{Start: quietStart, End: quietEnd}
+	}
+	return &prefs, nil
+}
+
+// AddDeadLetter records a failed notification.
+func (s *SQLStore) AddDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO dead_letters (notification_id, error, failed_at) VALUES ($1, $2, $3)
+		ON CONFLICT (notification_id) DO UPDATE SET error = excluded.error, failed_at = excluded.failed_at`,
+		dl.NotificationID, dl.Error, dl.FailedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save dead letter: %v", err)
+	}
+	return nil
+}
+
+// ListDeadLetters returns dead letters with their notifications, oldest first.
+func (s *SQLStore) ListDeadLetters(ctx context.Context) ([]*DeadLetter, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+notificationColumns+`, d.error, d.failed_at
+		FROM dead_letters d JOIN notifications n ON n.id = d.notification_id
+		ORDER BY d.failed_at`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dead letters: %v", err)
+	}
+	defer rows.Close()
+
+	letters := []*DeadLetter{}
+	for rows.Next() {
+		dl := &DeadLetter{}
+		n, err := scanNotification(rows, &dl.Error, &dl.FailedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dead letter: %v", err)
+		}
+		dl.NotificationID = n.ID
+		dl.Notification = n
+		letters = append(letters, dl)
+	}
+	return letters, rows.Err()
+}
+
+// RemoveDeadLetter deletes the dead letter for a notification.
+func (s *SQLStore) RemoveDeadLetter(ctx context.Context, notificationID string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM dead_letters WHERE notification_id = $1", notificationID)
+	if err != nil {
+		return fmt.Errorf("failed to delete dead letter: %v", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListOutbox returns the outbox entries created before `before` that are not done.
+func (s *SQLStore) ListOutbox(ctx context.Context, before time.Time, limit int) ([]OutboxEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT notification_id, version, created_at FROM outbox
+		WHERE done_at IS NULL AND created_at < $1
+		ORDER BY created_at, notification_id
+		LIMIT $2`, before.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []OutboxEntry
+	for rows.Next() {
+		var e OutboxEntry
+		if err := rows.Scan(&e.NotificationID, &e.Version, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox entry: %v", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// MarkOutboxDone marks outbox entries as handed to the scheduler.
+func (s *SQLStore) MarkOutboxDone(ctx context.Context, entries []OutboxEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "UPDATE outbox SET done_at = $1 WHERE notification_id = $2 AND version = $3")
+	if err != nil {
+		return fmt.Errorf("failed to prepare update: %v", err)
+	}
+	defer stmt.Close()
+	now := time.Now().UTC()
+	for _, e := range entries {
+		if _, err := stmt.ExecContext(ctx, now, e.NotificationID, e.Version); err != nil {
+			return fmt.Errorf("failed to mark outbox entry of %s done: %v", e.NotificationID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit outbox: %v", err)
+	}
+	return nil
+}
+
+// Close closes the underlying database.
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStores returns every NotificationStore implementation backed by throwaway storage.
+func newTestStores(t *testing.T) map[string]NotificationStore {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	sqlStore, err := NewSQLStore(db)
+	if err != nil {
+		t.Fatalf("NewSQLStore: %v", err)
+	}
+	t.Cleanup(func() { sqlStore.Close() })
+	return map[string]NotificationStore{
+		"memory": NewMemoryStore(),
+		"sqlite": sqlStore,
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			sendAt := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+			n := &Notification{
+				ID:        "n1",
+				TenantID:  "acme",
+				UserID:    "u1",
+				Priority:  PriorityHigh,
+				Message:   "hello",
+				Channel:   "email",
+				SendAt:    sendAt,
+				Status:    "pending",
+				CreatedAt: sendAt.Add(-time.Hour),
+			}
+			n.OriginalSendAt = sendAt
+			if err := store.Create(ctx, n); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+
+			got, err := store.Get(ctx, "n1")
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if got.UserID != "u1" || got.TenantID != "acme" || got.Priority != PriorityHigh || got.Message != "hello" || !got.SendAt.Equal(sendAt) {
+				t.Errorf("Unexpected notification: %+v", got)
+			}
+			if list, _ := store.List(ctx, NotificationFilter{TenantID: "globex"}); len(list) != 0 {
+				t.Errorf("Expected no notifications of another tenant, got %d", len(list))
+			}
+			if list, _ := store.List(ctx, NotificationFilter{TenantID: "acme"}); len(list) != 1 {
+				t.Errorf("Expected the tenant's notification, got %d", len(list))
+			}
+
+			if got.LastAttemptAt != nil || got.SentAt != nil {
+				t.Errorf("Expected no delivery timestamps, got %+v", got)
+			}
+
+			attemptAt := sendAt.Add(time.Second)
+			got.Retries = 2
+			got.Status = "sent"
+			got.Timezone = "Asia/Almaty"
+			got.SendAt = sendAt.Add(time.Minute)
+			got.ClaimedBy, got.ClaimedAt = "w1", &attemptAt
+			got.LastAttemptAt = &attemptAt
+			got.SentAt = &attemptAt
+			if err := store.Update(ctx, got); err != nil {
+				t.Fatalf("Update failed: %v", err)
+			}
+			got, _ = store.Get(ctx, "n1")
+			if got.Retries != 2 || got.Status != "sent" || got.Timezone != "Asia/Almaty" || !got.OriginalSendAt.Equal(sendAt) || got.ClaimedBy != "w1" {
+				t.Errorf("Expected updated notification, got %+v", got)
+			}
+			if got.SentAt == nil || !got.SentAt.Equal(attemptAt) || got.LastAttemptAt == nil || !got.LastAttemptAt.Equal(attemptAt) {
+				t.Errorf("Expected delivery timestamps %v, got %v and %v", attemptAt, got.LastAttemptAt, got.SentAt)
+			}
+
+			if _, err := store.Get(ctx, "missing"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreUpdateStatus(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			n := &Notification{ID: "n1", UserID: "u1", Channel: "email", Status: "pending", SendAt: time.Now(), CreatedAt: time.Now()}
+			if err := store.Create(ctx, n); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			if err := store.UpdateStatus(ctx, "n1", "pending", "cancelled"); err != nil {
+				t.Errorf("UpdateStatus failed: %v", err)
+			}
+			if err := store.UpdateStatus(ctx, "n1", "pending", "sent"); err != ErrStatusConflict {
+				t.Errorf("Expected ErrStatusConflict, got %v", err)
+			}
+			if err := store.UpdateStatus(ctx, "missing", "pending", "sent"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+			got, _ := store.Get(ctx, "n1")
+			if got.Status != "cancelled" {
+				t.Errorf("Expected status cancelled, got %s", got.Status)
+			}
+		})
+	}
+}
+
+func TestStoreVersionedEditAndClaim(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+			n := &Notification{ID: "n1", UserID: "u1", Message: "old", Channel: "email", Status: "pending", SendAt: now, CreatedAt: now, Version: 1}
+			if err := store.Create(ctx, n); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+
+			edited := *n
+			edited.Message, edited.SendAt, edited.OriginalSendAt, edited.Version = "new", now.Add(time.Hour), now.Add(time.Hour), 2
+			if err := store.UpdatePending(ctx, &edited, 1); err != nil {
+				t.Fatalf("UpdatePending failed: %v", err)
+			}
+			// A second edit based on version 1 lost the race.
+			if err := store.UpdatePending(ctx, &edited, 1); err != ErrStatusConflict {
+				t.Errorf("Expected ErrStatusConflict for a stale edit, got %v", err)
+			}
+			got, _ := store.Get(ctx, "n1")
+			if got.Message != "new" || got.Version != 2 || !got.SendAt.Equal(now.Add(time.Hour)) || !got.OriginalSendAt.Equal(now.Add(time.Hour)) {
+				t.Errorf("Unexpected notification after edit: %+v", got)
+			}
+
+			if err := store.Claim(ctx, "n1", 1, "w1", now); err != ErrStatusConflict {
+				t.Errorf("Expected ErrStatusConflict when claiming a stale version, got %v", err)
+			}
+			if err := store.Claim(ctx, "n1", 2, "w1", now); err != nil {
+				t.Errorf("Claim failed: %v", err)
+			}
+			if err := store.UpdatePending(ctx, &edited, 2); err != ErrStatusConflict {
+				t.Errorf("Expected ErrStatusConflict when editing a claimed notification, got %v", err)
+			}
+			if err := store.Claim(ctx, "missing", 0, "w1", now); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+
+			claimed, _ := store.Get(ctx, "n1")
+			if claimed.ClaimedBy != "w1" || claimed.ClaimedAt == nil || !claimed.ClaimedAt.Equal(now) {
+				t.Errorf("Expected the claim of w1 at %v, got %q at %v", now, claimed.ClaimedBy, claimed.ClaimedAt)
+			}
+			claimed.Retries = 1
+			if err := store.UpdateClaimed(ctx, claimed, "w2"); err != ErrStatusConflict {
+				t.Errorf("Expected ErrStatusConflict when another owner writes back, got %v", err)
+			}
+			if err := store.UpdateClaimed(ctx, claimed, "w1"); err != nil {
+				t.Errorf("UpdateClaimed failed: %v", err)
+			}
+
+			// The claim is released only once it is older than claimedBefore.
+			if released, err := store.ReleaseStaleClaims(ctx, now); err != nil || len(released) != 0 {
+				t.Errorf("Expected no stale claims yet, got %+v (%v)", released, err)
+			}
+			released, err := store.ReleaseStaleClaims(ctx, now.Add(time.Second))
+			if err != nil || len(released) != 1 || released[0].ClaimedBy != "w1" || released[0].Version != 3 {
+				t.Fatalf("Expected n1 to be released at version 3, got %+v (%v)", released, err)
+			}
+			got, _ = store.Get(ctx, "n1")
+			if got.Status != "pending" || got.Version != 3 {
+				t.Errorf("Expected n1 pending at version 3, got %s at %d", got.Status, got.Version)
+			}
+			entries, _ := store.ListOutbox(ctx, time.Now().Add(time.Hour), 10)
+			if len(entries) == 0 || entries[len(entries)-1].Version != 3 {
+				t.Errorf("Expected an outbox entry for version 3, got %+v", entries)
+			}
+			if err := store.Claim(ctx, "n1", 2, "w2", now); err != ErrStatusConflict {
+				t.Errorf("Expected ErrStatusConflict when claiming the version before the release, got %v", err)
+			}
+			claimed.Status = "sent"
+			if err := store.UpdateClaimed(ctx, claimed, "w1"); err != ErrStatusConflict {
+				t.Errorf("Expected ErrStatusConflict when writing back a released claim, got %v", err)
+			}
+			if got, _ := store.Get(ctx, "n1"); got.Status != "pending" || got.Version != 3 {
+				t.Errorf("Expected n1 to stay pending at version 3, got %s at %d", got.Status, got.Version)
+			}
+		})
+	}
+}
+
+func TestStoreOutbox(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now()
+			later := now.Add(time.Minute)
+			n := &Notification{ID: "n1", UserID: "u1", Channel: "email", Status: "pending", SendAt: now, CreatedAt: now, Version: 1}
+			if err := store.Create(ctx, n); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			if err := store.CreateMany(ctx, []*Notification{{ID: "n2", UserID: "u1", Channel: "email", Status: "pending", SendAt: now, CreatedAt: now, Version: 1}}); err != nil {
+				t.Fatalf("CreateMany failed: %v", err)
+			}
+			entries, err := store.ListOutbox(ctx, later, 10)
+			if err != nil {
+				t.Fatalf("ListOutbox failed: %v", err)
+			}
+			if len(entries) != 2 || entries[0].NotificationID != "n1" || entries[0].Version != 1 {
+				t.Fatalf("Unexpected outbox %+v", entries)
+			}
+			if entries, _ := store.ListOutbox(ctx, now.Add(-time.Minute), 10); len(entries) != 0 {
+				t.Errorf("Expected no entries created before the cutoff, got %+v", entries)
+			}
+
+			if err := store.MarkOutboxDone(ctx, entries); err != nil {
+				t.Fatalf("MarkOutboxDone failed: %v", err)
+			}
+			edited := *n
+			edited.Version = 2
+			if err := store.UpdatePending(ctx, &edited, 1); err != nil {
+				t.Fatalf("UpdatePending failed: %v", err)
+			}
+			entries, _ = store.ListOutbox(ctx, later, 10)
+			if len(entries) != 1 || entries[0].NotificationID != "n1" || entries[0].Version != 2 {
+				t.Errorf("Expected only the edited version in the outbox, got %+v", entries)
+			}
+		})
+	}
+}
+
+func TestStoreDeadLetters(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+			for _, id := range []string{"n1", "n2"} {
+				n := &Notification{ID: id, UserID: "u1", Channel: "email", Status: "failed", SendAt: now, CreatedAt: now}
+				if err := store.Create(ctx, n); err != nil {
+					t.Fatalf("Create failed: %v", err)
+				}
+			}
+			store.AddDeadLetter(ctx, &DeadLetter{NotificationID: "n2", Error: "boom", FailedAt: now.Add(time.Minute)})
+			store.AddDeadLetter(ctx, &DeadLetter{NotificationID: "n1", Error: "first", FailedAt: now})
+			store.AddDeadLetter(ctx, &DeadLetter{NotificationID: "n1", Error: "second", FailedAt: now.Add(2 * time.Minute)})
+
+			letters, err := store.ListDeadLetters(ctx)
+			if err != nil {
+				t.Fatalf("ListDeadLetters failed: %v", err)
+			}
+			if len(letters) != 2 || letters[0].NotificationID != "n2" || letters[1].Error != "second" {
+				t.Fatalf("Unexpected dead letters %+v", letters)
+			}
+			if letters[0].Notification == nil || letters[0].Notification.UserID != "u1" {
+				t.Errorf("Expected notification to be attached, got %+v", letters[0].Notification)
+			}
+
+			if err := store.RemoveDeadLetter(ctx, "n2"); err != nil {
+				t.Errorf("RemoveDeadLetter failed: %v", err)
+			}
+			if err := store.RemoveDeadLetter(ctx, "n2"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreListAndSeries(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+			series := &Series{ID: "s1", TenantID: "acme", UserID: "u1", Channel: "email", Priority: PriorityLow, Schedule: "@daily", Active: true, CreatedAt: now}
+			if err := store.CreateSeries(ctx, series); err != nil {
+				t.Fatalf("CreateSeries failed: %v", err)
+			}
+			for i, id := range []string{"b", "a", "c"} {
+				n := &Notification{ID: id, UserID: "u1", Channel: "email", Status: "pending", SeriesID: "s1",
+					SendAt: now.Add(time.Duration(i) * time.Hour), CreatedAt: now}
+				if id == "c" {
+					n.SeriesID = ""
+				}
+				store.Create(ctx, n)
+			}
+
+			list, err := store.List(ctx, NotificationFilter{SeriesID: "s1", Status: "pending"})
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			if len(list) != 2 || list[0].ID != "b" || list[1].ID != "a" {
+				t.Errorf("Expected [b a], got %+v", list)
+			}
+
+			series.Active = false
+			if err := store.UpdateSeries(ctx, series); err != nil {
+				t.Fatalf("UpdateSeries failed: %v", err)
+			}
+			got, err := store.GetSeries(ctx, "s1")
+			if err != nil || got.Active || got.Schedule != "@daily" || got.TenantID != "acme" || got.Priority != PriorityLow {
+				t.Errorf("Unexpected series %+v (%v)", got, err)
+			}
+			if _, err := store.GetSeries(ctx, "missing"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreListFilterAndPage(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+			for _, n := range []*Notification{
+				{ID: "n1", UserID: "u1", Channel: "email", SendAt: now},
+				{ID: "n3", UserID: "u1", Channel: "email", SendAt: now.Add(time.Hour)},
+				{ID: "n2", UserID: "u1", Channel: "email", SendAt: now.Add(time.Hour)},
+				{ID: "n4", UserID: "u1", Channel: "telegram", SendAt: now.Add(2 * time.Hour)},
+				{ID: "n5", UserID: "u1", Channel: "email", SendAt: now.Add(3 * time.Hour)},
+				{ID: "n6", UserID: "u2", Channel: "email", SendAt: now.Add(time.Hour)},
+			} {
+				n.Status = "pending"
+				n.CreatedAt = now
+				if err := store.Create(ctx, n); err != nil {
+					t.Fatalf("Create failed: %v", err)
+				}
+			}
+
+			filter := NotificationFilter{UserID: "u1", Channel: "email", To: now.Add(3 * time.Hour), Limit: 2}
+			var ids []string
+			for page := 0; page < 3; page++ {
+				list, err := store.List(ctx, filter)
+				if err != nil {
+					t.Fatalf("List failed: %v", err)
+				}
+				for _, n := range list {
+					ids = append(ids, n.ID)
+				}
+				if len(list) < filter.Limit {
+					break
+				}
+				last := list[len(list)-1]
+				filter.AfterSendAt, filter.AfterID = last.SendAt, last.ID
+			}
+			if got := strings.Join(ids, " "); got != "n1 n2 n3" {
+				t.Errorf("Expected n1 n2 n3, got %s", got)
+			}
+
+			list, _ := store.List(ctx, NotificationFilter{UserID: "u1", From: now.Add(time.Hour)})
+			if len(list) != 4 || list[0].ID != "n2" {
+				t.Errorf("Expected 4 notifications from n2, got %d", len(list))
+			}
+		})
+	}
+}
+
+func TestStoreTemplatesAndPreferences(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+			tmpl := &Template{TenantID: "acme", ID: "t1", DefaultLocale: "en", Variants: map[string]string{"en": "Hi {{.name}}"}, UpdatedAt: now}
+			if err := store.SaveTemplate(ctx, tmpl); err != nil {
+				t.Fatalf("SaveTemplate failed: %v", err)
+			}
+			tmpl.Variants = map[string]string{"en": "Hello {{.name}}", "ru": "Привет {{.name}}"}
+			if err := store.SaveTemplate(ctx, tmpl); err != nil {
+				t.Fatalf("SaveTemplate (replace) failed: %v", err)
+			}
+			got, err := store.GetTemplate(ctx, "acme", "t1")
+			if err != nil || got.TenantID != "acme" || len(got.Variants) != 2 || got.Variants["ru"] != "Привет {{.name}}" {
+				t.Errorf("Unexpected template %+v (%v)", got, err)
+			}
+			if _, err := store.GetTemplate(ctx, "acme", "missing"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+			// Template IDs are only unique within a tenant.
+			if _, err := store.GetTemplate(ctx, "globex", "t1"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for another tenant, got %v", err)
+			}
+			if err := store.SaveTemplate(ctx, &Template{TenantID: "globex", ID: "t1", DefaultLocale: "en", Variants: map[string]string{"en": "Yo"}, UpdatedAt: now}); err != nil {
+				t.Fatalf("SaveTemplate for another tenant failed: %v", err)
+			}
+			if got, _ := store.GetTemplate(ctx, "acme", "t1"); got == nil || len(got.Variants) != 2 {
+				t.Errorf("Expected acme's template to be kept, got %+v", got)
+			}
+
+			err = store.SavePreferences(ctx, &UserPreferences{
+				TenantID:   "acme",
+				UserID:     "u1",
+				Email:      "u1@example.com",
+				Channels:   []string{"telegram", "email"},
+				Locale:     "ru",
+				Timezone:   "Europe/Moscow",
+				QuietHours: &QuietHours{Start: "23:00", End: "07:00"},
+				UpdatedAt:  now,
+			})
+			if err != nil {
+				t.Fatalf("SavePreferences failed: %v", err)
+			}
+			prefs, err := store.GetPreferences(ctx, "acme", "u1")
+			if err != nil || prefs.TenantID != "acme" || prefs.Locale != "ru" || prefs.Email != "u1@example.com" || len(prefs.Channels) != 2 ||
+				prefs.Channels[0] != "telegram" || prefs.QuietHours == nil || prefs.QuietHours.End != "07:00" {
+				t.Errorf("Unexpected preferences %+v (%v)", prefs, err)
+			}
+			// Another tenant's user with the same ID has preferences of their own.
+			if _, err := store.GetPreferences(ctx, "globex", "u1"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for another tenant, got %v", err)
+			}
+			if err := store.SavePreferences(ctx, &UserPreferences{TenantID: "globex", UserID: "u1", Email: "u1@globex.test", UpdatedAt: now}); err != nil {
+				t.Fatalf("SavePreferences failed: %v", err)
+			}
+			if prefs, _ := store.GetPreferences(ctx, "acme", "u1"); prefs == nil || prefs.Email != "u1@example.com" {
+				t.Errorf("Expected acme's preferences to be kept, got %+v", prefs)
+			}
+
+			n := &Notification{ID: "n1", UserID: "u1", TemplateID: "t1", TemplateData: map[string]any{"name": "Ann"},
+				Channel: "email", Status: "pending", SendAt: now, CreatedAt: now}
+			store.Create(ctx, n)
+			stored, _ := store.Get(ctx, "n1")
+			if stored.TemplateID != "t1" || stored.TemplateData["name"] != "Ann" {
+				t.Errorf("Expected template reference to round-trip, got %+v", stored)
+			}
+		})
+	}
+}
+
+func TestStoreStatusHistory(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+			store.Create(ctx, &Notification{ID: "n1", UserID: "u1", Channel: "email", Status: "pending", SendAt: now, CreatedAt: now})
+			for _, c := range []StatusChange{
+				{Status: "pending", Reason: "created", At: now},
+				{Status: "sending", At: now},
+				{Status: "sent", At: now},
+			} {
+				if err := store.AddStatusChange(ctx, "n1", c); err != nil {
+					t.Fatalf("AddStatusChange failed: %v", err)
+				}
+			}
+			history, err := store.ListStatusChanges(ctx, "n1")
+			if err != nil {
+				t.Fatalf("ListStatusChanges failed: %v", err)
+			}
+			if len(history) != 3 || history[0].Reason != "created" || history[2].Status != "sent" || !history[2].At.Equal(now) {
+				t.Errorf("Unexpected history %+v", history)
+			}
+		})
+	}
+}
+
+func TestStoreAttempts(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+			store.Create(ctx, &Notification{ID: "n1", UserID: "u1", Channel: "auto", Status: "pending", SendAt: now, CreatedAt: now})
+			for _, a := range []DeliveryAttempt{
+				{Attempt: 1, Channel: "telegram", Response: "HTTP 403 Forbidden", Error: "telegram: Forbidden (HTTP 403)", At: now},
+				{Attempt: 1, Channel: "email", At: now},
+			} {
+				if err := store.AddAttempt(ctx, "n1", a); err != nil {
+					t.Fatalf("AddAttempt failed: %v", err)
+				}
+			}
+			attempts, err := store.ListAttempts(ctx, "n1")
+			if err != nil {
+				t.Fatalf("ListAttempts failed: %v", err)
+			}
+			if len(attempts) != 2 || attempts[0].Response != "HTTP 403 Forbidden" || attempts[0].Error == "" ||
+				attempts[1].Channel != "email" || attempts[1].Error != "" || !attempts[1].At.Equal(now) {
+				t.Errorf("Unexpected attempts %+v", attempts)
+			}
+			if attempts, err := store.ListAttempts(ctx, "n2"); err != nil || len(attempts) != 0 {
+				t.Errorf("Expected no attempts, got %+v, %v", attempts, err)
+			}
+		})
+	}
+}
+
+func TestStoreCreateManyAndCount(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+			var batch []*Notification
+			for _, id := range []string{"n1", "n2", "n3"} {
+				batch = append(batch, &Notification{ID: id, UserID: "u1", Channel: "email", Status: "pending",
+					BatchID: "b1", SendAt: now, CreatedAt: now})
+			}
+			if err := store.CreateMany(ctx, batch); err != nil {
+				t.Fatalf("CreateMany failed: %v", err)
+			}
+			store.UpdateStatus(ctx, "n2", "pending", "cancelled")
+
+			counts, err := store.CountByStatus(ctx, NotificationFilter{BatchID: "b1"})
+			if err != nil || counts["pending"] != 2 || counts["cancelled"] != 1 {
+				t.Errorf("Unexpected counts %v (%v)", counts, err)
+			}
+
+			// A duplicate ID rolls back the whole batch.
+			dup := []*Notification{
+				{ID: "n4", UserID: "u1", Channel: "email", Status: "pending", BatchID: "b2", SendAt: now, CreatedAt: now},
+				{ID: "n1", UserID: "u1", Channel: "email", Status: "pending", BatchID: "b2", SendAt: now, CreatedAt: now},
+			}
+			if err := store.CreateMany(ctx, dup); err == nil {
+				t.Error("Expected an error for a duplicate ID")
+			}
+			if _, err := store.Get(ctx, "n4"); err != ErrNotFound {
+				t.Errorf("Expected n4 to be rolled back, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSQLStoreMigratesOldSchema(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	// The tables as the first releases of each created them, with a row in each.
+	sendAt := time.Date(2025, 9, 20, 10, 0, 0, 0, time.UTC)
+	_, err = db.Exec(`
+		CREATE TABLE notifications (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			message TEXT NOT NULL,
+			channel TEXT NOT NULL,
+			send_at TIMESTAMP NOT NULL,
+			status TEXT NOT NULL,
+			retries INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE series (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			message TEXT NOT NULL,
+			channel TEXT NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			schedule TEXT NOT NULL,
+			timezone TEXT NOT NULL DEFAULT '',
+			active BOOLEAN NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE user_preferences (
+			user_id TEXT PRIMARY KEY,
+			locale TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE templates (
+			id TEXT PRIMARY KEY,
+			default_locale TEXT NOT NULL,
+			variants TEXT NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+	`)
+	if err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO notifications (id, user_id, message, channel, send_at, status, retries, created_at)
+		VALUES ('old', 'u1', 'hi', 'email', $1, 'pending', 0, $1)`, sendAt); err != nil {
+		t.Fatalf("insert old notification: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO user_preferences (user_id, locale, updated_at) VALUES ('u1', 'ru', $1)`, sendAt); err != nil {
+		t.Fatalf("insert old preferences: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO templates (id, default_locale, variants, updated_at) VALUES ('t1', 'en', '{"en":"hi"}', $1)`, sendAt); err != nil {
+		t.Fatalf("insert old template: %v", err)
+	}
+
+	// Opening the store twice shows the migration can run again.
+	var store *SQLStore
+	for i := 0; i < 2; i++ {
+		if store, err = NewSQLStore(db); err != nil {
+			t.Fatalf("NewSQLStore %d failed: %v", i, err)
+		}
+	}
+	ctx := context.Background()
+	old, err := store.Get(ctx, "old")
+	if err != nil || old.Version != 1 || old.Priority != PriorityNormal || old.TenantID != "" || !old.OriginalSendAt.Equal(sendAt) {
+		t.Fatalf("Expected the old notification with defaults, got %+v (%v)", old, err)
+	}
+	if err := store.Claim(ctx, "old", 1, "w1", sendAt); err != nil {
+		t.Errorf("Claim of the old notification failed: %v", err)
+	}
+
+	n := &Notification{ID: "new", TenantID: "acme", UserID: "u1", Message: "hi", Channel: "email", Priority: PriorityHigh,
+		SendAt: sendAt, OriginalSendAt: sendAt, Status: "pending", CreatedAt: sendAt, Version: 1}
+	if err := store.Create(ctx, n); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if list, err := store.List(ctx, NotificationFilter{TenantID: "acme"}); err != nil || len(list) != 1 || list[0].Priority != PriorityHigh {
+		t.Errorf("Expected acme's notification, got %+v (%v)", list, err)
+	}
+	series := &Series{ID: "s1", TenantID: "acme", UserID: "u1", Message: "hi", Channel: "email", Schedule: "0 9 * * *",
+		Priority: PriorityLow, Active: true, CreatedAt: sendAt}
+	if err := store.CreateSeries(ctx, series); err != nil {
+		t.Fatalf("CreateSeries failed: %v", err)
+	}
+	if got, err := store.GetSeries(ctx, "s1"); err != nil || got.TenantID != "acme" || got.Priority != PriorityLow {
+		t.Errorf("Expected the series to round-trip, got %+v (%v)", got, err)
+	}
+
+	// The old preferences keep the empty tenant; another tenant's u1 can be added.
+	if prefs, err := store.GetPreferences(ctx, "", "u1"); err != nil || prefs.Locale != "ru" {
+		t.Errorf("Expected the old preferences, got %+v (%v)", prefs, err)
+	}
+	if err := store.SavePreferences(ctx, &UserPreferences{TenantID: "acme", UserID: "u1", Email: "u1@acme.test", UpdatedAt: sendAt}); err != nil {
+		t.Errorf("SavePreferences for another tenant failed: %v", err)
+	}
+	// So does the old template.
+	if tmpl, err := store.GetTemplate(ctx, "", "t1"); err != nil || tmpl.Variants["en"] != "hi" {
+		t.Errorf("Expected the old template, got %+v (%v)", tmpl, err)
+	}
+	if err := store.SaveTemplate(ctx, &Template{TenantID: "acme", ID: "t1", DefaultLocale: "en", Variants: map[string]string{"en": "yo"}, UpdatedAt: sendAt}); err != nil {
+		t.Errorf("SaveTemplate for another tenant failed: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// telegram.go - delivery through the Telegram Bot API
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TelegramSender sends notifications with the Bot API sendMessage method.
+// The chat ID is the notification target, or the user ID when there is none.
+type TelegramSender struct {
+	token  string
+	apiURL string
+	client *http.Client
+}
+
+// NewTelegramSender creates a TelegramSender. apiURL defaults to https://api.telegram.org.
+func NewTelegramSender(token, apiURL string) *TelegramSender {
+	if apiURL == "" {
+		apiURL = "https://api.telegram.org"
+	}
+	return &TelegramSender{
+		token:  token,
+		apiURL: strings.TrimSuffix(apiURL, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// telegramResponse is the envelope returned by every Bot API method.
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description"`
+	Result      struct {
+		MessageID int64 `json:"message_id"`
+	} `json:"result"`
+}
+
+// Send calls sendMessage.
+func (s *TelegramSender) Send(ctx context.Context, notification *Notification) error {
+	_, err := s.SendWithResponse(ctx, notification)
+	return err
+}
+
+// SendWithResponse calls sendMessage and returns the ID of the sent message,
+// or the API's description of the failure.
+func (s *TelegramSender) SendWithResponse(ctx context.Context, notification *Notification) (string, error) {
+	body, err := json.Marshal(map[string]string{
+		"chat_id": recipient(notification),
+		"text":    notification.Message,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%s/bot%s/sendMessage", s.apiURL, s.token)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// Do not leak the bot token through the request URL in the error.
+		return "", fmt.Errorf("telegram: request failed: %v", strings.ReplaceAll(err.Error(), s.token, "***"))
+	}
+	defer resp.Body.Close()
+
+	var result telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Sprintf("HTTP %d", resp.StatusCode), fmt.Errorf("telegram: unexpected response (HTTP %d)", resp.StatusCode)
+	}
+	if !result.OK {
+		response := fmt.Sprintf("HTTP %d %s", resp.StatusCode, result.Description)
+		err := fmt.Errorf("telegram: %s (HTTP %d)", result.Description, resp.StatusCode)
+		if isPermanentStatus(resp.StatusCode) {
+			return response, Permanent(err)
+		}
+		return response, err
+	}
+	return fmt.Sprintf("message_id %d", result.Result.MessageID), nil
+}
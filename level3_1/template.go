@@ -0,0 +1,176 @@
+// template.go - named message templates with localized variants
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Template is a named message template of a tenant. Variants maps a locale
+// such as "en" or "pt-BR" to a text/template source rendered with the
+// notification data. Notifications can only use their own tenant's templates.
+type Template struct {
+	TenantID      string            `json:"tenant_id,omitempty"`
+	ID            string            `json:"id"`
+	DefaultLocale string            `json:"default_locale"`
+	Variants      map[string]string `json:"variants"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+// validate checks the template and makes sure every variant parses.
+func (t *Template) validate() error {
+	if t.ID == "" || strings.Contains(t.ID, "/") {
+		return fmt.Errorf("template id must be non-empty and must not contain '/'")
+	}
+	if len(t.Variants) == 0 {
+		return fmt.Errorf("template needs at least one variant")
+	}
+	if t.DefaultLocale == "" && len(t.Variants) == 1 {
+		for locale := range t.Variants {
+			t.DefaultLocale = locale
+		}
+	}
+	if _, ok := t.Variants[t.DefaultLocale]; !ok {
+		return fmt.Errorf("default_locale must name one of the variants")
+	}
+	for locale := range t.Variants {
+		if _, err := t.parse(locale); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parse compiles the variant for locale. Missing data keys are errors rather than "<no value>".
+func (t *Template) parse(locale string) (*template.Template, error) {
+	tmpl, err := template.New(t.ID + "." + locale).Option("missingkey=error").Parse(t.Variants[locale])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s variant: %v", locale, err)
+	}
+	return tmpl, nil
+}
+
+// variant picks the variant for locale, falling back to its base language
+// ("pt" for "pt-BR") and then to the default locale.
+func (t *Template) variant(locale string) string {
+	if _, ok := t.Variants[locale]; ok {
+		return locale
+	}
+	if base, _, ok := strings.Cut(locale, "-"); ok {
+		if _, ok := t.Variants[base]; ok {
+			return base
+		}
+	}
+	return t.DefaultLocale
+}
+
+// Render executes the variant for locale with data.
+func (t *Template) Render(locale string, data map[string]any) (string, error) {
+	tmpl, err := t.parse(t.variant(locale))
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// SaveTemplate creates or replaces a template.
+func (d *DelayedNotifier) SaveTemplate(t *Template) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	t.UpdatedAt = d.now()
+	return d.store.SaveTemplate(context.Background(), t)
+}
+
+// renderMessage fills in the message of a templated notification in the
+// recipient's locale. Rendering problems will not go away on retry, so they
+// are permanent errors.
+func (d *DelayedNotifier) renderMessage(ctx context.Context, notification *Notification, prefs *UserPreferences) error {
+	if notification.TemplateID == "" {
+		return nil
+	}
+	t, err := d.store.GetTemplate(ctx, notification.TenantID, notification.TemplateID)
+	if err == ErrNotFound {
+		return Permanent(fmt.Errorf("template %s not found", notification.TemplateID))
+	}
+	if err != nil {
+		return err
+	}
+
+	locale := ""
+	if prefs != nil {
+		locale = prefs.Locale
+	}
+	message, err := t.Render(locale, notification.TemplateData)
+	if err != nil {
+		return Permanent(fmt.Errorf("template %s: %v", t.ID, err))
+	}
+	notification.Message = message
+	return nil
+}
+
+// SaveTemplateHandler handles POST /templates. The template belongs to the
+// tenant named by ?tenant_id=, by default the caller's own.
+func (d *DelayedNotifier) SaveTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	tenantID, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, `{"error": "tenant_id names another tenant"}`, http.StatusForbidden)
+		return
+	}
+
+	var t Template
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, `{"error": "invalid JSON body"}`, http.StatusBadRequest)
+		return
+	}
+	t.TenantID = tenantID
+	if err := d.SaveTemplate(&t); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]*Template{"result": &t})
+}
+
+// GetTemplateHandler handles GET /templates/{id}. Like SaveTemplateHandler,
+// it reads the tenant from ?tenant_id=, by default the caller's own.
+func (d *DelayedNotifier) GetTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error": "method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	tenantID, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, `{"error": "tenant_id names another tenant"}`, http.StatusForbidden)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/templates/")
+	t, err := d.store.GetTemplate(context.Background(), tenantID, id)
+	if err == ErrNotFound {
+		http.Error(w, `{"error": "template not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]*Template{"result": t})
+}
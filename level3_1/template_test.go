@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// messageSender remembers the rendered messages it was asked to send.
+type messageSender struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (s *messageSender) Send(ctx context.Context, notification *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, notification.Message)
+	return nil
+}
+
+func TestTemplateRenderLocaleFallback(t *testing.T) {
+	tmpl := &Template{
+		ID:            "welcome",
+		DefaultLocale: "en",
+		Variants: map[string]string{
+			"en": "Hello, {{.name}}!",
+			"pt": "Olá, {{.name}}!",
+			"ru": "Привет, {{.name}}!",
+		},
+	}
+	if err := tmpl.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+	for locale, want := range map[string]string{"ru": "Привет, Ann!", "pt-BR": "Olá, Ann!", "de": "Hello, Ann!", "": "Hello, Ann!"} {
+		got, err := tmpl.Render(locale, map[string]any{"name": "Ann"})
+		if err != nil || got != want {
+			t.Errorf("Render(%q): expected %q, got %q (%v)", locale, want, got, err)
+		}
+	}
+	if _, err := tmpl.Render("en", nil); err == nil {
+		t.Error("Expected an error for missing data")
+	}
+
+	bad := &Template{ID: "bad", Variants: map[string]string{"en": "{{.name"}}
+	if err := bad.validate(); err == nil {
+		t.Error("Expected an error for an unparsable variant")
+	}
+}
+
+func TestTemplatedNotificationUsesUserLocale(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	sender := &messageSender{}
+	d.senders.Register("email", sender)
+
+	err := d.SaveTemplate(&Template{
+		ID:            "reminder",
+		DefaultLocale: "en",
+		Variants:      map[string]string{"en": "Meeting at {{.time}}", "kk": "Кездесу {{.time}}"},
+	})
+	if err != nil {
+		t.Fatalf("SaveTemplate failed: %v", err)
+	}
+	if err := d.SavePreferences(&UserPreferences{UserID: "aigerim", Locale: "kk"}); err != nil {
+		t.Fatalf("SavePreferences failed: %v", err)
+	}
+
+	sendAt := time.Now().Add(time.Hour)
+	data := map[string]any{"time": "10:00"}
+	for _, user := range []string{"aigerim", "bob"} {
+		req := NotificationRequest{UserID: user, TemplateID: "reminder", TemplateData: data, Channel: "email", SendAt: sendAt}
+		if _, err := d.CreateNotification(req); err != nil {
+			t.Fatalf("CreateNotification failed: %v", err)
+		}
+	}
+	broker.drain(d)
+
+	got := strings.Join(sender.messages, "|")
+	if got != "Кездесу 10:00|Meeting at 10:00" {
+		t.Errorf("Unexpected messages %q", got)
+	}
+
+	req := NotificationRequest{UserID: "bob", TemplateID: "missing", Channel: "email", SendAt: sendAt}
+	if _, err := d.CreateNotification(req); err == nil {
+		t.Error("Expected an error for an unknown template")
+	}
+}
+
+func TestTemplateRenderErrorFailsDelivery(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	d.SaveTemplate(&Template{ID: "greet", Variants: map[string]string{"en": "Hi {{.name}}"}})
+
+	id, err := d.CreateNotification(NotificationRequest{UserID: "bob", TemplateID: "greet", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	broker.drain(d)
+
+	n, _ := d.store.Get(context.Background(), id)
+	if n.Status != "failed" || !strings.Contains(n.LastError, `template greet`) || !strings.Contains(n.LastError, "name") {
+		t.Errorf("Expected a failed delivery with a template error, got %s: %s", n.Status, n.LastError)
+	}
+	if len(sender.sentIDs()) != 0 {
+		t.Error("Expected nothing to be sent")
+	}
+	attempts, _ := d.store.ListAttempts(context.Background(), id)
+	if len(attempts) != 1 || attempts[0].Channel != "email" || !strings.Contains(attempts[0].Error, "template greet") {
+		t.Errorf("Expected the render error to be recorded as an attempt, got %+v", attempts)
+	}
+}
+
+func TestTemplatesArePerTenant(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	sender := &messageSender{}
+	d.senders.Register("email", sender)
+
+	save := func(r *http.Request) int {
+		rec := httptest.NewRecorder()
+		d.SaveTemplateHandler(rec, r)
+		return rec.Code
+	}
+	get := func(r *http.Request) int {
+		rec := httptest.NewRecorder()
+		d.GetTemplateHandler(rec, r)
+		return rec.Code
+	}
+	if code := save(asTenant(httptest.NewRequest(http.MethodPost, "/templates", strings.NewReader(`{"id": "welcome", "variants": {"en": "Hi from acme"}}`)), "acme")); code != http.StatusOK {
+		t.Fatalf("Expected acme to save its template, got %d", code)
+	}
+	if code := save(asTenant(httptest.NewRequest(http.MethodPost, "/templates?tenant_id=acme", strings.NewReader(`{"id": "welcome", "variants": {"en": "Hi from globex"}}`)), "globex")); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for globex writing acme's template, got %d", code)
+	}
+	if code := get(asTenant(httptest.NewRequest(http.MethodGet, "/templates/welcome", nil), "globex")); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another tenant's template, got %d", code)
+	}
+	if code := get(asAdmin(httptest.NewRequest(http.MethodGet, "/templates/welcome?tenant_id=acme", nil), "ops")); code != http.StatusOK {
+		t.Errorf("Expected an admin to read acme's template, got %d", code)
+	}
+
+	// globex cannot send with acme's template, and its own template of the
+	// same name does not change acme's notifications.
+	sendAt := time.Now().Add(time.Hour)
+	if _, err := d.CreateNotification(NotificationRequest{TenantID: "globex", UserID: "bob", TemplateID: "welcome", Channel: "email", SendAt: sendAt}); err == nil {
+		t.Error("Expected an error for another tenant's template")
+	}
+	if code := save(asTenant(httptest.NewRequest(http.MethodPost, "/templates", strings.NewReader(`{"id": "welcome", "variants": {"en": "Hi from globex"}}`)), "globex")); code != http.StatusOK {
+		t.Fatalf("Expected globex to save its own template, got %d", code)
+	}
+	if _, err := d.CreateNotification(NotificationRequest{TenantID: "acme", UserID: "bob", TemplateID: "welcome", Channel: "email", SendAt: sendAt}); err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	d.handleDelivery(<-broker.deliveries)
+	if len(sender.messages) != 1 || sender.messages[0] != "Hi from acme" {
+		t.Errorf("Expected acme's template to be rendered, got %v", sender.messages)
+	}
+}
@@ -0,0 +1,246 @@
+// webhook.go - delivery to generic HTTP webhooks and Slack incoming webhooks
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// SignatureHeader carries "sha256=" followed by the hex HMAC of "<timestamp>.<body>".
+	SignatureHeader = "X-Notifier-Signature"
+	// TimestampHeader carries the Unix time the request was signed at.
+	TimestampHeader = "X-Notifier-Timestamp"
+)
+
+// TargetValidator is implemented by senders whose notifications need a target.
+type TargetValidator interface {
+	ValidateTarget(target string) error
+}
+
+// errPrivateTarget is returned for targets on loopback, private, link-local
+// and other internal addresses, which callers must not be able to reach
+// through the notifier.
+var errPrivateTarget = errors.New("target address is not public")
+
+// internalPrefixes are non-public ranges that net/netip has no predicate for.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+}
+
+// publicAddr reports whether notifications may be posted to addr.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range internalPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// refusePrivateAddr is a net.Dialer Control function that refuses to connect
+// to non-public addresses. It runs on the resolved address of every
+// connection, so a host name that resolves, or later rebinds, to an internal
+// address is refused as well.
+func refusePrivateAddr(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return Permanent(fmt.Errorf("%w: %s", errPrivateTarget, address))
+	}
+	if !publicAddr(addrPort.Addr()) {
+		return Permanent(fmt.Errorf("%w: %s", errPrivateTarget, addrPort.Addr()))
+	}
+	return nil
+}
+
+// newTargetClient returns the HTTP client for user-supplied targets. It
+// ignores proxy settings, which would hide the target address from the dialer.
+func newTargetClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: refusePrivateAddr}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}
+}
+
+// validateURL checks that target is an absolute http(s) URL and, unless
+// allowPrivate is set, not a literal internal address. Host names are
+// checked when connecting.
+func validateURL(target string, allowPrivate bool) error {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("target must be an http or https URL")
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !allowPrivate && !publicAddr(addr) {
+		return errPrivateTarget
+	}
+	return nil
+}
+
+// postJSON posts body to target and turns non-2xx responses into errors. It
+// returns the response status and the start of the response body. The body
+// is the receiver's data, so the error carries only the status: errors end up
+// in LastError, status history and events that every tenant user can see.
+func postJSON(ctx context.Context, client *http.Client, target string, body []byte, header http.Header) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	response := strings.TrimSpace(fmt.Sprintf("HTTP %d %s", resp.StatusCode, bytes.TrimSpace(snippet)))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("HTTP %d", resp.StatusCode)
+		if isPermanentStatus(resp.StatusCode) {
+			return response, Permanent(err)
+		}
+		return response, err
+	}
+	return response, nil
+}
+
+// isPermanentStatus reports whether an HTTP status means the request will never succeed as is.
+func isPermanentStatus(code int) bool {
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
+// SignWebhook returns the signature header value for a webhook body.
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether signature matches the body. Receivers can use it as a reference.
+func VerifyWebhook(secret []byte, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
+
+// webhookPayload is the JSON body posted to webhooks.
+type webhookPayload struct {
+	ID      string    `json:"id"`
+	UserID  string    `json:"user_id"`
+	Message string    `json:"message"`
+	SendAt  time.Time `json:"send_at"`
+	Retries int       `json:"retries"`
+}
+
+// WebhookSender posts notifications as signed JSON to the notification's target URL.
+type WebhookSender struct {
+	secret []byte
+	client *http.Client
+	// allowPrivate accepts internal target addresses; tests use it with an unguarded client.
+	allowPrivate bool
+}
+
+// NewWebhookSender creates a WebhookSender that signs with secret. It only
+// posts to public addresses.
+func NewWebhookSender(secret string) *WebhookSender {
+	return &WebhookSender{
+		secret: []byte(secret),
+		client: newTargetClient(),
+	}
+}
+
+// ValidateTarget requires an http(s) URL.
+func (s *WebhookSender) ValidateTarget(target string) error {
+	return validateURL(target, s.allowPrivate)
+}
+
+// Send posts the notification.
+func (s *WebhookSender) Send(ctx context.Context, notification *Notification) error {
+	_, err := s.SendWithResponse(ctx, notification)
+	return err
+}
+
+// SendWithResponse posts the notification and returns the receiver's response.
+func (s *WebhookSender) SendWithResponse(ctx context.Context, notification *Notification) (string, error) {
+	body, err := json.Marshal(webhookPayload{
+		ID:      notification.ID,
+		UserID:  notification.UserID,
+		Message: notification.Message,
+		SendAt:  notification.SendAt,
+		Retries: notification.Retries,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header := http.Header{}
+	header.Set(TimestampHeader, timestamp)
+	header.Set(SignatureHeader, SignWebhook(s.secret, timestamp, body))
+	response, err := postJSON(ctx, s.client, notification.Target, body, header)
+	if err != nil {
+		return response, fmt.Errorf("webhook: %w", err)
+	}
+	return response, nil
+}
+
+// SlackSender posts notifications to a Slack incoming webhook URL given as the target.
+type SlackSender struct {
+	client *http.Client
+	// allowPrivate accepts internal target addresses; tests use it with an unguarded client.
+	allowPrivate bool
+}
+
+// NewSlackSender creates a SlackSender. It only posts to public addresses.
+func NewSlackSender() *SlackSender {
+	return &SlackSender{client: newTargetClient()}
+}
+
+// ValidateTarget requires an http(s) URL.
+func (s *SlackSender) ValidateTarget(target string) error {
+	return validateURL(target, s.allowPrivate)
+}
+
+// Send posts the message text.
+func (s *SlackSender) Send(ctx context.Context, notification *Notification) error {
+	_, err := s.SendWithResponse(ctx, notification)
+	return err
+}
+
+// SendWithResponse posts the message text and returns Slack's response.
+func (s *SlackSender) SendWithResponse(ctx context.Context, notification *Notification) (string, error) {
+	body, err := json.Marshal(map[string]string{"text": notification.Message})
+	if err != nil {
+		return "", err
+	}
+	response, err := postJSON(ctx, s.client, notification.Target, body, nil)
+	if err != nil {
+		return response, fmt.Errorf("slack: %w", err)
+	}
+	return response, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker is an in-memory stand-in for RabbitMQ. It implements Scheduler
+// and Broker by queueing a delivery right away, ignoring SendAt and delays,
+// and records acknowledgements.
+type fakeBroker struct {
+	mu         sync.Mutex
+	deliveries chan Delivery
+	nextTag    uint64
+	acked      []uint64
+	nacked     []uint64
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{deliveries: make(chan Delivery, 100)}
+}
+
+func (b *fakeBroker) Schedule(ctx context.Context, notification *Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	return b.Publish(ctx, laneOf(notification.Priority), body, 0)
+}
+
+func (b *fakeBroker) Run(ctx context.Context) {}
+
+func (b *fakeBroker) Publish(ctx context.Context, lane string, body []byte, delay time.Duration) error {
+	b.mu.Lock()
+	b.nextTag++
+	tag := b.nextTag
+	b.mu.Unlock()
+	b.deliveries <- Delivery{Body: body, Acknowledger: fakeAcknowledger{broker: b, tag: tag}}
+	return nil
+}
+
+func (b *fakeBroker) Ready() <-chan struct{} {
+	ready := make(chan struct{})
+	close(ready)
+	return ready
+}
+
+// Consume hands every consumer the same channel, whatever the lane, so they
+// compete for deliveries like RabbitMQ consumers do.
+func (b *fakeBroker) Consume(ctx context.Context, lane string) (<-chan Delivery, error) {
+	return b.deliveries, nil
+}
+
+func (b *fakeBroker) Close() error { return nil }
+
+// ackCount returns how many deliveries were acknowledged.
+func (b *fakeBroker) ackCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.acked)
+}
+
+// fakeAcknowledger records how a fakeBroker delivery was settled.
+type fakeAcknowledger struct {
+	broker *fakeBroker
+	tag    uint64
+}
+
+func (a fakeAcknowledger) Ack() error {
+	a.broker.mu.Lock()
+	defer a.broker.mu.Unlock()
+	a.broker.acked = append(a.broker.acked, a.tag)
+	return nil
+}
+
+func (a fakeAcknowledger) Nack(requeue bool) error {
+	a.broker.mu.Lock()
+	defer a.broker.mu.Unlock()
+	a.broker.nacked = append(a.broker.nacked, a.tag)
+	return nil
+}
+
+// drain hands every queued delivery to the notifier.
+func (b *fakeBroker) drain(d *DelayedNotifier) {
+	for {
+		select {
+		case msg := <-b.deliveries:
+			d.handleDelivery(msg)
+		default:
+			return
+		}
+	}
+}
+
+// recordingSender remembers every notification it was asked to send.
+type recordingSender struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (s *recordingSender) Send(ctx context.Context, notification *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, notification.ID)
+	return nil
+}
+
+func (s *recordingSender) sentIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.sent...)
+}
+
+// newTestNotifier builds a DelayedNotifier on an in-memory store, an in-process
+// Redis and a fake broker, with a recording sender on the "email" channel.
+func newTestNotifier(t *testing.T) (*DelayedNotifier, *fakeBroker, *recordingSender) {
+	broker := newFakeBroker()
+	sender := &recordingSender{}
+	d := &DelayedNotifier{
+		store:     NewMemoryStore(),
+		scheduler: broker,
+		senders:   NewSenderRegistry(),
+		now:       time.Now,
+		rand:      func() float64 { return 0 },
+		redis:     newTestRedis(t),
+	}
+	d.senders.Register("email", sender)
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	t.Cleanup(d.cancel)
+	return d, broker, sender
+}
+
+func TestCancelledNotificationIsNeverSent(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	sendAt := time.Now().Add(time.Hour)
+
+	keep, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "keep", Channel: "email", SendAt: sendAt})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	drop, err := d.CreateNotification(NotificationRequest{UserID: "bob", Message: "drop", Channel: "email", SendAt: sendAt})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	if err := d.CancelNotification(drop); err != nil {
+		t.Fatalf("CancelNotification failed: %v", err)
+	}
+
+	// Both messages are already sitting in the queue with status "pending".
+	broker.drain(d)
+
+	if sent := sender.sentIDs(); len(sent) != 1 || sent[0] != keep {
+		t.Errorf("Expected only %s to be sent, got %v", keep, sent)
+	}
+	if status, _ := d.GetNotificationStatus(keep); status != "sent" {
+		t.Errorf("Expected %s to be sent, got %s", keep, status)
+	}
+	if status, _ := d.GetNotificationStatus(drop); status != "cancelled" {
+		t.Errorf("Expected %s to stay cancelled, got %s", drop, status)
+	}
+	if len(broker.acked) != 2 || len(broker.nacked) != 0 {
+		t.Errorf("Expected 2 acks and no nacks, got %v and %v", broker.acked, broker.nacked)
+	}
+	if err := d.CancelNotification(keep); err == nil {
+		t.Error("CancelNotification should fail for a sent notification")
+	}
+}
+
+func TestFailedWebhookIsRetried(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	sender := NewWebhookSender("secret")
+	sender.client, sender.allowPrivate = srv.Client(), true
+	d.senders.Register("webhook", sender)
+
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "webhook", Target: srv.URL, SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	d.handleDelivery(<-broker.deliveries)
+
+	n, _ := d.store.Get(context.Background(), id)
+	if n.Status != "pending" || n.Retries != 1 {
+		t.Errorf("Expected pending with 1 retry, got %s with %d", n.Status, n.Retries)
+	}
+	if len(broker.deliveries) == 0 {
+		t.Error("Expected the notification to be rescheduled")
+	}
+
+	req := NotificationRequest{UserID: "alice", Message: "hi", Channel: "webhook", Target: "not a url", SendAt: time.Now().Add(time.Hour)}
+	if _, err := d.CreateNotification(req); err == nil {
+		t.Error("CreateNotification should reject an invalid webhook target")
+	}
+}
+
+// blockingSender holds every send until release is closed.
+type blockingSender struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSender) Send(ctx context.Context, notification *Notification) error {
+	s.started <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func TestConsumeStopsWhenDeliveriesClose(t *testing.T) {
+	d, broker, sender := newTestNotifier(t)
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	// A dropped connection closes the delivery channel, which must end consume
+	// instead of spinning on zero-value deliveries.
+	close(broker.deliveries)
+
+	done := make(chan struct{})
+	go func() {
+		msgs, _ := consumeLanes(context.Background(), broker)
+		d.consume(msgs)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("consume did not return after the delivery channel was closed")
+	}
+	if sent := sender.sentIDs(); len(sent) != 1 || sent[0] != id {
+		t.Errorf("Expected %s to be sent before returning, got %v", id, sent)
+	}
+}
+
+// laneBroker gives every consumer its own channel per lane, like a RabbitMQ
+// connection does, and remembers the context each consumer was registered with.
+type laneBroker struct {
+	*fakeBroker
+	mu        sync.Mutex
+	consumers []laneConsumer
+}
+
+// laneConsumer is one Consume call on a laneBroker.
+type laneConsumer struct {
+	ctx        context.Context
+	deliveries chan Delivery
+}
+
+func (b *laneBroker) Consume(ctx context.Context, lane string) (<-chan Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := laneConsumer{ctx: ctx, deliveries: make(chan Delivery)}
+	b.consumers = append(b.consumers, c)
+	return c.deliveries, nil
+}
+
+// consumer waits for the i-th Consume call.
+func (b *laneBroker) consumer(t *testing.T, i int) laneConsumer {
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.mu.Lock()
+		if i < len(b.consumers) {
+			c := b.consumers[i]
+			b.mu.Unlock()
+			return c
+		}
+		b.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected at least %d consumers", i+1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerStopsOtherLanesWhenOneCloses(t *testing.T) {
+	d, fake, _ := newTestNotifier(t)
+	broker := &laneBroker{fakeBroker: fake}
+	d.running.Add(1)
+	go d.worker(broker)
+
+	// One lane loses its consumer, as after a reconnect. The consumers of the
+	// other lanes must be stopped too, or their forwarding goroutines block
+	// on deliveries nobody reads.
+	high, normal, low := broker.consumer(t, 0), broker.consumer(t, 1), broker.consumer(t, 2)
+	close(high.deliveries)
+	for _, c := range []laneConsumer{normal, low} {
+		select {
+		case <-c.ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Expected the consumers of the other lanes to be stopped")
+		}
+	}
+	// The worker consumes every lane again.
+	if c := broker.consumer(t, 5); c.ctx.Err() != nil {
+		t.Errorf("Expected the new consumers to be running, got %v", c.ctx.Err())
+	}
+
+	d.cancel()
+	d.running.Wait()
+}
+
+func TestShutdownDrainsInFlightDelivery(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	sender := &blockingSender{started: make(chan struct{}), release: make(chan struct{})}
+	d.senders.Register("email", sender)
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		msgs, _ := consumeLanes(context.Background(), broker)
+		d.consume(msgs)
+	}()
+
+	id, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	<-sender.started
+
+	done := make(chan error)
+	go func() { done <- d.Shutdown(context.Background()) }()
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned while a delivery was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(sender.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if n, _ := d.store.Get(context.Background(), id); n.Status != "sent" {
+		t.Errorf("Expected the in-flight notification to be sent, got %s", n.Status)
+	}
+	if len(broker.acked) != 1 {
+		t.Errorf("Expected the delivery to be acked, got %v", broker.acked)
+	}
+}
+
+func TestShutdownGivesUpAfterDeadline(t *testing.T) {
+	d, broker, _ := newTestNotifier(t)
+	sender := &blockingSender{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(sender.release)
+	d.senders.Register("email", sender)
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		msgs, _ := consumeLanes(context.Background(), broker)
+		d.consume(msgs)
+	}()
+
+	if _, err := d.CreateNotification(NotificationRequest{UserID: "alice", Message: "hi", Channel: "email", SendAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("CreateNotification failed: %v", err)
+	}
+	<-sender.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.Shutdown(ctx); err == nil {
+		t.Error("Shutdown should report deliveries that did not finish in time")
+	}
+}